@@ -16,11 +16,10 @@ package merger
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/dfuse-io/dmetrics"
 	"github.com/dfuse-io/merger/metrics"
-	"io/ioutil"
-	"strconv"
 	"time"
 
 	"github.com/dfuse-io/dgrpc"
@@ -29,22 +28,58 @@ import (
 	pbhealth "github.com/dfuse-io/pbgo/grpc/health/v1"
 	"github.com/dfuse-io/shutter"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type Config struct {
-	StorageOneBlockFilesPath     string
-	StorageMergedBlocksFilesPath string
-	GRPCListenAddr               string
-	Live                         bool
-	StartBlockNum                uint64
-	StopBlockNum                 uint64
-	ProgressFilename             string
-	MinimalBlockNum              uint64
-	WritersLeewayDuration        time.Duration
-	TimeBetweenStoreLookups      time.Duration
-	SeenBlocksFile               string
-	MaxFixableFork               uint64
-	DeleteBlocksBefore           bool
+	StorageOneBlockFilesPath         string
+	StorageMergedBlocksFilesPath     string
+	GRPCListenAddr                   string
+	Live                             bool
+	StartBlockNum                    uint64
+	StopBlockNum                     uint64
+	ProgressFilename                 string
+	MinimalBlockNum                  uint64
+	WritersLeewayDuration            time.Duration
+	TimeBetweenStoreLookups          time.Duration
+	SeenBlocksFile                   string
+	MaxFixableFork                   uint64
+	DeleteBlocksBefore               bool
+	WatchOneBlockFiles               bool          // only applies to local one-block files stores
+	TimeBetweenFullWalks             time.Duration // when watching, full walks of the one-block files store are still done at this interval, defaults to 5 minutes
+	ListBatchSize                    int           // maximum number of one-block files kept from a single listing, defaults to 2000
+	SparseChain                      bool          // chain can skip block numbers, bundles can start or end on missing slots
+	FirstStreamableBlock             *uint64       // first block of the chain, like a snapshot height, nil defaults to 2 like EOSIO
+	GenesisPreviousID                string        // optional previous ID of the first streamable block
+	BlockOrdering                    string        // order of blocks within merged files, "time" (default) or "number"
+	OneBlockFilenameLayout           string        // padding of block numbers in one-block filenames, "v0" (10 digits, default) or "v1" (20 digits)
+	MergedFilenameLayout             string        // padding of block numbers in merged filenames, "v0" (10 digits, default) or "v1" (20 digits)
+	StorageQuarantinedFilesPath      string        // when set, one-block files that cannot be decoded or validated are moved there instead of stopping the merger
+	UploadRetryBudget                time.Duration // failing uploads of merged files are retried for that long before terminating, defaults to 15 minutes
+	StoreRetryAttempts               int           // attempts of store operations (listing, downloads, deletes, quarantine and state), defaults to 5
+	StoreRetryBaseBackoff            time.Duration // wait before retrying a failed store operation, doubled on each attempt, defaults to 500ms
+	StoreRetryMaxBackoff             time.Duration // maximum wait between attempts of a store operation, defaults to 5s
+	StoreRetryJitter                 float64       // fraction of the wait randomly added or removed, defaults to 0.2
+	DownloadConcurrency              int           // maximum number of one-block files downloaded at the same time, defaults to 64
+	DownloadCacheDir                 string        // when set, downloaded one-block files are kept in this local directory and survive restarts
+	DownloadCacheMaxSize             int64         // size in bytes over which the least recently used files of the download cache are evicted, defaults to 1GiB
+	PendingDeletionsFile             string        // when set, one-block files not deleted yet are persisted there and retried after a restart
+	DeleteConcurrency                int           // maximum number of one-block files deleted at the same time, defaults to 64
+	SweepInterval                    time.Duration // with DeleteBlocksBefore, time between full walks of the one-block files store looking for leftovers, defaults to 1 hour
+	RetentionMode                    string        // what happens to merged or too old one-block files, "delete" (default), "keep-blocks", "keep-duration" or "archive"
+	RetentionKeepBlocks              uint64        // with "keep-blocks", number of blocks below the last merged one whose files are kept
+	RetentionKeepDuration            time.Duration // with "keep-duration", age of blocks under which their files are kept
+	StorageArchivedOneBlockFilesPath string        // with "archive", store receiving the one-block files removed from the source store
+	MergeJournalFile                 string        // when set, the phases of each merge are recorded there so a restart resumes an interrupted merge
+	StartupConsistencyPolicy         string        // when the progress file, seen cache and destination store disagree at startup, "warn" (default), "refuse" or "auto-correct", which also lets live mode start at a hole of the destination store
+	StorageStatePath                 string        // when set, the seen blocks cache and progress are kept in this store instead of SeenBlocksFile and ProgressFilename
+	HealthMaxHeadDrift               time.Duration // in live mode, head block drift over which the merger reports itself unhealthy, 0 disables
+	HealthMaxTimeWithoutNewFiles     time.Duration // time without new one-block files after which the merger reports itself unhealthy, 0 disables
+	StorageBundleManifestsPath       string        // when set, a JSON manifest describing each merged file, fork statistics included, is written to this store
+	ForkAlertDepth                   int           // depth of a fork within a bundle from which an alert is logged, defaults to 12, negative disables
+	StallTimeout                     time.Duration // time a hole blocks a bundle before it is reported as stalled with diagnostics, defaults to 5 minutes
+	StallWebhookURL                  string        // when set, stall reports are posted there as JSON
 }
 
 type App struct {
@@ -75,19 +110,134 @@ func (a *App) Run() error {
 		return fmt.Errorf("failed to init destination archive store: %w", err)
 	}
 
-	m := merger.NewMerger(sourceArchiveStore, destArchiveStore, a.config.WritersLeewayDuration, a.config.MinimalBlockNum, a.config.ProgressFilename, a.config.DeleteBlocksBefore, a.config.SeenBlocksFile, a.config.TimeBetweenStoreLookups, a.config.MaxFixableFork, a.config.GRPCListenAddr)
+	ordering, err := merger.ParseBlockOrdering(a.config.BlockOrdering)
+	if err != nil {
+		return err
+	}
+
+	oneBlockLayout, err := merger.ParseFilenameLayout(a.config.OneBlockFilenameLayout)
+	if err != nil {
+		return fmt.Errorf("one-block filename layout: %w", err)
+	}
+	mergedLayout, err := merger.ParseFilenameLayout(a.config.MergedFilenameLayout)
+	if err != nil {
+		return fmt.Errorf("merged filename layout: %w", err)
+	}
+
+	opts := []merger.Option{
+		merger.WithBlockOrdering(ordering),
+		merger.WithFilenameLayouts(oneBlockLayout, mergedLayout),
+	}
+	if a.config.WatchOneBlockFiles {
+		opts = append(opts, merger.WithFilesystemWatch(a.config.TimeBetweenFullWalks))
+	}
+	if a.config.FirstStreamableBlock != nil {
+		opts = append(opts, merger.WithFirstStreamableBlock(*a.config.FirstStreamableBlock, a.config.GenesisPreviousID))
+	} else if a.config.GenesisPreviousID != "" {
+		opts = append(opts, merger.WithFirstStreamableBlock(merger.DefaultFirstStreamableBlock, a.config.GenesisPreviousID))
+	}
+	if a.config.SparseChain {
+		opts = append(opts, merger.WithSparseChain())
+	}
+	if a.config.StorageQuarantinedFilesPath != "" {
+		quarantineStore, err := dstore.NewDBinStore(a.config.StorageQuarantinedFilesPath)
+		if err != nil {
+			return fmt.Errorf("failed to init quarantine store: %w", err)
+		}
+		quarantineAnnotationsStore, err := dstore.NewSimpleStore(a.config.StorageQuarantinedFilesPath)
+		if err != nil {
+			return fmt.Errorf("failed to init quarantine annotations store: %w", err)
+		}
+		opts = append(opts, merger.WithQuarantine(quarantineStore, quarantineAnnotationsStore))
+	}
+	retryPolicy := merger.DefaultRetryPolicy()
+	if a.config.StoreRetryAttempts > 0 {
+		retryPolicy.Attempts = a.config.StoreRetryAttempts
+	}
+	if a.config.StoreRetryBaseBackoff > 0 {
+		retryPolicy.BaseBackoff = a.config.StoreRetryBaseBackoff
+	}
+	if a.config.StoreRetryMaxBackoff > 0 {
+		retryPolicy.MaxBackoff = a.config.StoreRetryMaxBackoff
+	}
+	if a.config.StoreRetryJitter > 0 {
+		retryPolicy.Jitter = a.config.StoreRetryJitter
+	}
+	opts = append(opts, merger.WithRetryPolicy(retryPolicy))
+
+	if a.config.UploadRetryBudget > 0 {
+		opts = append(opts, merger.WithUploadRetryBudget(a.config.UploadRetryBudget))
+	}
+	if a.config.DownloadConcurrency > 0 {
+		opts = append(opts, merger.WithDownloadConcurrency(a.config.DownloadConcurrency))
+	}
+	if a.config.DownloadCacheDir != "" {
+		maxSize := a.config.DownloadCacheMaxSize
+		if maxSize <= 0 {
+			maxSize = merger.DefaultDownloadCacheMaxSize
+		}
+		opts = append(opts, merger.WithDownloadCache(a.config.DownloadCacheDir, maxSize))
+	}
+	retention, err := a.retentionPolicy()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, merger.WithRetention(retention))
+	if a.config.MergeJournalFile != "" {
+		opts = append(opts, merger.WithMergeJournal(a.config.MergeJournalFile))
+	}
+	opts = append(opts, merger.WithJanitor(a.config.PendingDeletionsFile, a.config.DeleteConcurrency, a.config.SweepInterval))
+	if a.config.StorageStatePath != "" {
+		stateStore, err := dstore.NewSimpleStore(a.config.StorageStatePath)
+		if err != nil {
+			return fmt.Errorf("failed to init state store: %w", err)
+		}
+		opts = append(opts, merger.WithStateStore(stateStore))
+	}
+	if a.config.StorageBundleManifestsPath != "" {
+		manifestStore, err := dstore.NewSimpleStore(a.config.StorageBundleManifestsPath)
+		if err != nil {
+			return fmt.Errorf("failed to init bundle manifests store: %w", err)
+		}
+		opts = append(opts, merger.WithManifestStore(manifestStore))
+	}
+	if a.config.ForkAlertDepth != 0 {
+		opts = append(opts, merger.WithForkAlertDepth(a.config.ForkAlertDepth))
+	}
+	if a.config.StallTimeout > 0 || a.config.StallWebhookURL != "" {
+		stallTimeout := a.config.StallTimeout
+		if stallTimeout <= 0 {
+			stallTimeout = merger.DefaultStallTimeout
+		}
+		opts = append(opts, merger.WithStallDetection(stallTimeout, a.config.StallWebhookURL))
+	}
+	opts = append(opts, merger.WithHealthThresholds(a.config.HealthMaxHeadDrift, a.config.HealthMaxTimeWithoutNewFiles))
+	if a.config.ListBatchSize > 0 {
+		opts = append(opts, merger.WithListBatchSize(a.config.ListBatchSize))
+	}
+
+	m := merger.NewMerger(sourceArchiveStore, destArchiveStore, a.config.WritersLeewayDuration, a.config.MinimalBlockNum, a.config.ProgressFilename, a.config.DeleteBlocksBefore, a.config.SeenBlocksFile, a.config.TimeBetweenStoreLookups, a.config.MaxFixableFork, a.config.GRPCListenAddr, opts...)
 	zlog.Info("merger initiated")
 
+	consistencyPolicy, err := merger.ParseConsistencyPolicy(a.config.StartupConsistencyPolicy)
+	if err != nil {
+		return err
+	}
+
 	var startBlockNum uint64
 	var stopBlockNum uint64
 	if a.config.Live {
+		// the bundles after a hole would be merged again from one-block
+		// files already deleted, only an operator asking for it starts
+		// at the hole
+		var hole *merger.HoleError
 		startBlockNum, err = m.FindNextBaseBlock()
-		if err != nil {
+		if err != nil && !(errors.As(err, &hole) && consistencyPolicy == merger.ConsistencyAutoCorrect) {
 			return fmt.Errorf("finding where to start: %w", err)
 		}
 	} else {
 		startBlockNum = a.config.StartBlockNum
-		if start, err := getStartBlockFromProgressFile(a.config.ProgressFilename); err == nil {
+		if start, err := getStartBlockFromProgressFile(m); err == nil {
 			if start > startBlockNum {
 				startBlockNum = start
 			}
@@ -95,6 +245,12 @@ func (a *App) Run() error {
 		stopBlockNum = a.config.StopBlockNum
 	}
 
+	progressBlock, _ := getStartBlockFromProgressFile(m)
+	startBlockNum, _, err = m.ReconcileStart(startBlockNum, progressBlock, consistencyPolicy)
+	if err != nil {
+		return err
+	}
+
 	m.SetupBundle(startBlockNum, stopBlockNum)
 
 	gs, err := dgrpc.NewInternalClient(a.config.GRPCListenAddr)
@@ -117,7 +273,8 @@ func (a *App) IsReady() bool {
 		return false
 	}
 
-	resp, err := a.readinessProbe.Check(context.Background(), &pbhealth.HealthCheckRequest{})
+	var trailer metadata.MD
+	resp, err := a.readinessProbe.Check(context.Background(), &pbhealth.HealthCheckRequest{}, grpc.Trailer(&trailer))
 	if err != nil {
 		zlog.Info("merger readiness probe error", zap.Error(err))
 		return false
@@ -127,20 +284,34 @@ func (a *App) IsReady() bool {
 		return true
 	}
 
+	zlog.Debug("merger not ready", zap.Strings("reasons", trailer.Get(merger.HealthReasonKey)))
 	return false
 }
 
-func getStartBlockFromProgressFile(filename string) (uint64, error) {
-	if filename == "" {
-		return 0, fmt.Errorf("filename not set")
-	}
-	content, err := ioutil.ReadFile(filename)
+func getStartBlockFromProgressFile(m *merger.Merger) (uint64, error) {
+	progress, err := m.ReadProgress()
 	if err != nil {
 		return 0, err
 	}
-	val, err := strconv.ParseUint(fmt.Sprintf("%s", content), 10, 64)
+	return progress.NextBlock, nil
+}
+
+func (a *App) retentionPolicy() (out merger.RetentionPolicy, err error) {
+	out.Mode, err = merger.ParseRetentionMode(a.config.RetentionMode)
 	if err != nil {
-		return 0, err
+		return
+	}
+	out.KeepBlocks = a.config.RetentionKeepBlocks
+	out.KeepDuration = a.config.RetentionKeepDuration
+
+	if out.Mode == merger.RetainArchive {
+		if a.config.StorageArchivedOneBlockFilesPath == "" {
+			return out, fmt.Errorf("archive retention mode requires an archive store")
+		}
+		out.ArchiveStore, err = dstore.NewDBinStore(a.config.StorageArchivedOneBlockFilesPath)
+		if err != nil {
+			return out, fmt.Errorf("failed to init archive store: %w", err)
+		}
 	}
-	return val, nil
+	return
 }
@@ -15,16 +15,20 @@
 package merger
 
 import (
-	"context"
-	"io/ioutil"
+	"bytes"
+	"fmt"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/dstore"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 )
 
+var errBundleAbandoned = fmt.Errorf("bundle abandoned")
+
 type Bundle struct {
 	fileList map[string]*OneBlockFile // key: "0000000100-20170701T122141.0-24a07267-e5914b39" ->
 
@@ -34,7 +38,33 @@ type Bundle struct {
 	upperBlockID   string // this would correspond to the block_id of the LAST NewTestBlock of the bundle, 38918199
 	upperBlockTime time.Time
 
-	downloadWaitGroup *errgroup.Group
+	// sparse chains can skip block numbers, the upper bound is then
+	// given by the first block at or above `upperBlock()` and the
+	// lower bound by a link to an already merged block.
+	sparse             bool
+	upperBlockNum      uint64          // number of the block that set the upper bound, in sparse mode
+	mergedTailIDs      map[string]bool // IDs of already merged blocks below lowerBlock, in sparse mode
+	mergedTailBlockIDs []string        // complete IDs of the last merged blocks, read from merged files on a cold start
+
+	firstStreamableBlock    uint64 // first block of the chain, the bundle containing it can't start lower
+	firstStreamableBlockSet bool   // tells a configured block 0 apart from the default
+	genesisPreviousID       string // optional previous ID of the first block of the chain
+
+	ordering BlockOrdering
+
+	upperLIB   uint64                   // highest LIB found in files at or above the upper boundary
+	duplicates map[string]*OneBlockFile // same block as a file of fileList, from another producer
+
+	keepFailedDownloads bool // record validation errors of downloaded files instead of failing the bundle
+
+	retryPolicy RetryPolicy
+	terminating <-chan struct{} // stops download retries, never closed when nil
+	abandoned   chan struct{}   // closed when the bundle will not be merged
+	abandonOnce sync.Once
+
+	downloads         *downloadScheduler
+	cache             *downloadCache // optional local copy of downloaded payloads
+	downloadWaitGroup *downloadGroup
 }
 
 func (b *Bundle) upperBlock() uint64 {
@@ -44,25 +74,131 @@ func (b *Bundle) upperBlock() uint64 {
 func NewBundle(lowerBlockNum, chunkSize uint64) *Bundle {
 	zlog.Info("Creating new bundle", zap.Uint64("lower_block_num", lowerBlockNum), zap.Uint64("chunk_size", chunkSize))
 	b := &Bundle{
-		chunkSize:  chunkSize,
-		lowerBlock: lowerBlockNum,
-		fileList:   make(map[string]*OneBlockFile),
+		chunkSize:   chunkSize,
+		lowerBlock:  lowerBlockNum,
+		fileList:    make(map[string]*OneBlockFile),
+		duplicates:  make(map[string]*OneBlockFile),
+		retryPolicy: DefaultRetryPolicy(),
 	}
-	group := &errgroup.Group{}
-	b.downloadWaitGroup = group
+	b.downloads = newDownloadScheduler(DefaultDownloadConcurrency)
+	b.downloadWaitGroup = &downloadGroup{}
+	b.abandoned = make(chan struct{})
 	return b
 }
 
+// abandon cancels the queued and running downloads of a bundle that
+// will not be merged, like when it is replaced.
+func (b *Bundle) abandon() {
+	b.abandonOnce.Do(func() {
+		if b.abandoned != nil {
+			close(b.abandoned)
+		}
+		b.downloads.cancel(b.downloadWaitGroup, errBundleAbandoned)
+	})
+}
+
+// BlockOrdering is the order in which the blocks of a bundle are
+// written to the merged file. Both orderings are total, so merging the
+// same one-block files always gives the same merged file.
+type BlockOrdering int
+
+const (
+	// OrderByTime sorts by block time, then block number, then ID.
+	OrderByTime BlockOrdering = iota
+	// OrderByNumber sorts by block number, blocks of the canonical
+	// chain going before forked blocks of the same number, then by
+	// block time and ID.
+	OrderByNumber
+)
+
+func ParseBlockOrdering(in string) (BlockOrdering, error) {
+	switch in {
+	case "", "time":
+		return OrderByTime, nil
+	case "number":
+		return OrderByNumber, nil
+	}
+	return 0, fmt.Errorf("unknown block ordering %q, valid values are \"time\" and \"number\"", in)
+}
+
+func (o BlockOrdering) String() string {
+	if o == OrderByNumber {
+		return "number"
+	}
+	return "time"
+}
+
+// sortedFiles returns the files of the bundle in the order they should
+// be merged, according to the bundle's ordering.
+func (b *Bundle) sortedFiles() []*OneBlockFile {
+	if b.ordering == OrderByNumber {
+		return b.numberSortedFiles()
+	}
+	return b.timeSortedFiles()
+}
+
 func (b *Bundle) timeSortedFiles() (files []*OneBlockFile) {
 	for _, b := range b.fileList {
 		files = append(files, b)
 	}
-	sort.SliceStable(files, func(i, j int) bool {
-		return files[i].blockTime.Before(files[j].blockTime)
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].blockTime.Equal(files[j].blockTime) {
+			return files[i].blockTime.Before(files[j].blockTime)
+		}
+		if files[i].num != files[j].num {
+			return files[i].num < files[j].num
+		}
+		return files[i].id < files[j].id
+	})
+	return
+}
+
+func (b *Bundle) numberSortedFiles() (files []*OneBlockFile) {
+	canonical := b.canonicalIDs()
+	for _, b := range b.fileList {
+		files = append(files, b)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].num != files[j].num {
+			return files[i].num < files[j].num
+		}
+		if canonical[files[i].id] != canonical[files[j].id] {
+			return canonical[files[i].id]
+		}
+		if !files[i].blockTime.Equal(files[j].blockTime) {
+			return files[i].blockTime.Before(files[j].blockTime)
+		}
+		return files[i].id < files[j].id
 	})
 	return
 }
 
+// canonicalIDs returns the IDs of the blocks linked from the upper
+// block ID down to the lowest block of the bundle.
+func (b *Bundle) canonicalIDs() map[string]bool {
+	byID := make(map[string]*OneBlockFile, len(b.fileList))
+	for _, f := range b.fileList {
+		byID[f.id] = f
+	}
+
+	out := make(map[string]bool)
+	for f := byID[b.upperBlockID]; f != nil && !out[f.id]; f = byID[f.previousID] {
+		out[f.id] = true
+	}
+	return out
+}
+
+// tailFile returns the last block of the canonical chain of the bundle,
+// nil when the bundle has none.
+func (b *Bundle) tailFile() *OneBlockFile {
+	for _, f := range b.fileList {
+		if f.id == b.upperBlockID {
+			return f
+		}
+	}
+	return nil
+}
+
 func (b *Bundle) isComplete() (complete bool) {
 	prevID := b.upperBlockID
 	var lowestContiguous *OneBlockFile
@@ -78,39 +214,83 @@ func (b *Bundle) isComplete() (complete bool) {
 	}
 
 	if lowestContiguous == nil {
+		if b.sparse && b.isMergedTail(b.upperBlockID) {
+			return true // all slots of this bundle were skipped
+		}
 		zlog.Debug("did not find upperBlockID", zap.String("upper_block_id", b.upperBlockID))
 		return false //did not find upper previousID
 	}
 	if lowestContiguous.num <= b.lowerBlock { // accept blocks that are lower...
 		return true
 	}
-	if b.lowerBlock == 0 && lowestContiguous.num <= 2 {
-		return true
+	if b.sparse && b.isMergedTail(prevID) {
+		return true // slots between the last merged block and lowestContiguous were skipped
+	}
+	if first, contained := b.chainStart(); contained {
+		if lowestContiguous.num <= first {
+			return true
+		}
+		if prevID != "" && b.genesisPreviousID != "" && strings.HasSuffix(b.genesisPreviousID, prevID) {
+			return true
+		}
 	}
 
 	zlog.Warn("found a hole in a oneblock files", zap.Uint64("bundle_lower_block", b.lowerBlock), zap.Uint64("missing_block_num", lowestContiguous.num-1), zap.String("missing_block_id", prevID))
 	return false
 }
 
+// isMergedTail tells if `id`, as found in filenames, is an already
+// merged block below the bundle.
+func (b *Bundle) isMergedTail(id string) bool {
+	if id == "" {
+		return false
+	}
+	if b.mergedTailIDs[id] {
+		return true
+	}
+	for _, blockID := range b.mergedTailBlockIDs {
+		if strings.HasSuffix(blockID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainStart returns the first streamable block and tells if the bundle
+// contains it. When none is configured, bundle 0 starts at
+// `DefaultFirstStreamableBlock`, like merger always assumed.
+func (b *Bundle) chainStart() (first uint64, contained bool) {
+	if !b.firstStreamableBlockSet {
+		return DefaultFirstStreamableBlock, b.lowerBlock == 0
+	}
+	return b.firstStreamableBlock, b.firstStreamableBlock >= b.lowerBlock && b.firstStreamableBlock < b.upperBlock()
+}
+
 func (b *Bundle) triage(filename string, sourceStore dstore.Store, seenCache *SeenBlockCache) (processed bool, err error) {
 	if b.containsFilename(filename) {
 		return true, nil
 	}
 
-	blockNum, blockTime, blockIDSuffix, previousIDSuffix, err := parseFilename(filename)
+	oneBlock, err := parseOneBlockFilename(filename)
 	if err != nil {
 		return false, err
 	}
+	blockNum, blockTime, previousIDSuffix := oneBlock.num, oneBlock.blockTime, oneBlock.previousID
 
 	if blockNum < b.upperBlock() {
+		if existing := b.fileWithID(blockNum, oneBlock.id); existing != nil {
+			zlog.Info("skipping duplicate block from another producer",
+				zap.String("filename", filename),
+				zap.String("producer", oneBlock.producer),
+				zap.String("included_filename", existing.name),
+				zap.String("included_producer", existing.producer),
+			)
+			b.duplicates[filename] = oneBlock
+			return true, nil
+		}
+
 		zlog.Debug("adding and downloading file", zap.String("filename", filename), zap.Time("blocktime", blockTime), zap.Uint64("blockNum", blockNum))
-		b.addAndDownload(&OneBlockFile{
-			name:       filename,
-			blockTime:  blockTime,
-			id:         blockIDSuffix,
-			num:        blockNum,
-			previousID: previousIDSuffix,
-		}, sourceStore)
+		b.addAndDownload(oneBlock, sourceStore)
 		return true, nil
 	}
 
@@ -119,6 +299,21 @@ func (b *Bundle) triage(filename string, sourceStore dstore.Store, seenCache *Se
 		// TODO add that NewTestBlock to the previous bundle automatically to help with future replays-from-blockfile
 	}
 
+	if oneBlock.libNum > b.upperLIB {
+		b.upperLIB = oneBlock.libNum
+	}
+
+	if b.sparse {
+		// the first existing block at or above the boundary closes the bundle
+		if b.upperBlockTime.IsZero() || blockNum < b.upperBlockNum || (blockNum == b.upperBlockNum && blockTime.Before(b.upperBlockTime)) {
+			zlog.Debug("upper NewTestBlock moved", zap.Uint64("block_num", blockNum), zap.Time("block_time", blockTime))
+			b.upperBlockNum = blockNum
+			b.upperBlockID = previousIDSuffix
+			b.upperBlockTime = blockTime
+		}
+		return false, nil
+	}
+
 	if blockNum == b.upperBlock() {
 		if b.upperBlockTime.IsZero() || blockTime.Before(b.upperBlockTime) {
 			zlog.Debug("upper NewTestBlock time stretched", zap.Time("block_time", blockTime))
@@ -130,46 +325,116 @@ func (b *Bundle) triage(filename string, sourceStore dstore.Store, seenCache *Se
 	return false, nil
 }
 
+// upperBoundIrreversible returns true when a file past the bundle
+// reports a LIB covering the last block of the bundle, so no fork of
+// the bundle can show up anymore.
+func (b *Bundle) upperBoundIrreversible() bool {
+	return b.upperLIB != 0 && b.upperLIB+1 >= b.upperBlock()
+}
+
+func (b *Bundle) fileWithID(num uint64, id string) *OneBlockFile {
+	for _, f := range b.fileList {
+		if f.num == num && f.id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// filenames returns the names of all the one-block files accounted for
+// by this bundle, including duplicates that are not merged.
+func (b *Bundle) filenames() (out []string) {
+	for filename := range b.fileList {
+		out = append(out, filename)
+	}
+	for filename := range b.duplicates {
+		out = append(out, filename)
+	}
+	return
+}
+
 func (b *Bundle) containsFilename(filename string) bool {
-	_, found := b.fileList[filename]
+	if _, found := b.fileList[filename]; found {
+		return true
+	}
+	_, found := b.duplicates[filename]
 	return found
 }
 
 func (b *Bundle) addAndDownload(oneBlock *OneBlockFile, sourceStore dstore.Store) {
 	b.fileList[oneBlock.name] = oneBlock
 
-	b.downloadWaitGroup.Go(func() error {
-		// FIXME: we need to manage the error, make it bubble up, retry or something...
-		err := Retry(5, 500*time.Millisecond, func() error {
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-			defer cancel()
-
-			return downloadFile(ctx, oneBlock, sourceStore)
-		})
+	b.downloadWaitGroup.add()
+	b.downloads.schedule(b.downloadWaitGroup, oneBlock, func() {
+		b.downloadWaitGroup.done(b.download(oneBlock, sourceStore))
+	})
+}
 
-		if err != nil {
-			return err
+func (b *Bundle) download(oneBlock *OneBlockFile, sourceStore dstore.Store) error {
+	if b.cache != nil {
+		if data, found := b.cache.get(oneBlock.name); found {
+			oneBlock.blk = data
+			if err := validateOneBlock(oneBlock); err == nil {
+				return nil
+			}
+			oneBlock.blk = nil
+			b.cache.remove(oneBlock.name)
 		}
+	}
+
+	err := b.retryPolicy.Do("download", b.terminating, func() error {
+		ctx, cancel := contextWithCancelOn(b.terminating, DownloadTimeout)
+		defer cancel()
 
-		return nil
+		return downloadFile(ctx, oneBlock, sourceStore)
 	})
-}
 
-func downloadFile(ctx context.Context, bf *OneBlockFile, s dstore.Store) error {
-	out, err := s.OpenObject(ctx, bf.name)
 	if err != nil {
+		return err // a failed download is not a reason to quarantine the file
+	}
+
+	if err := validateOneBlock(oneBlock); err != nil {
+		if b.keepFailedDownloads {
+			oneBlock.err = err
+			return nil
+		}
 		return err
 	}
-	defer out.Close()
+	if b.cache != nil {
+		b.cache.put(oneBlock.name, oneBlock.blk)
+	}
+	return nil
+}
+
+// validateOneBlock decodes the downloaded block and ensures it is the
+// block described by the filename, so a corrupted or mis-named file
+// never makes it into a merged file.
+func validateOneBlock(bf *OneBlockFile) error {
+	blockReader, err := bstream.GetBlockReaderFactory.New(bytes.NewReader(bf.blk))
+	if err != nil {
+		return fmt.Errorf("invalid one-block file %q: unable to read: %s", bf.name, err)
+	}
+
+	block, err := blockReader.Read()
+	if block == nil {
+		return fmt.Errorf("invalid one-block file %q: unable to decode block: %s", bf.name, err)
+	}
+
+	switch {
+	case block.Number != bf.num:
+		return fmt.Errorf("invalid one-block file %q: block number is %d", bf.name, block.Number)
+	case !strings.HasSuffix(block.Id, bf.id):
+		return fmt.Errorf("invalid one-block file %q: block ID is %q", bf.name, block.Id)
+	case !strings.HasSuffix(block.PreviousId, bf.previousID):
+		return fmt.Errorf("invalid one-block file %q: previous block ID is %q", bf.name, block.PreviousId)
+	case bf.libNum != 0 && block.LibNum != bf.libNum:
+		return fmt.Errorf("invalid one-block file %q: LIB is %d", bf.name, block.LibNum)
+	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	// filenames only carry a truncated timestamp
+	if delta := block.Timestamp.Sub(bf.blockTime); delta <= -time.Second || delta >= time.Second {
+		return fmt.Errorf("invalid one-block file %q: block time is %s", bf.name, block.Timestamp)
 	}
 
-	// TODO: In the future, implement `ctx` cancellation *during* download here.. would require
-	//       splitting `ReadAll` in chunks and check if the context is `Done` between each chunk.
-	bf.blk, err = ioutil.ReadAll(out)
-	return err
+	return nil
 }
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func contiguousBlocksGetter(from, to uint64) func() map[string]*OneBlockFile {
@@ -58,6 +59,75 @@ func TestIsComplete(t *testing.T) {
 			},
 			expectComplete: true,
 		},
+		{
+			name:           "beginning with a hole above the first streamable block",
+			fileListGetter: contiguousBlocksGetter(10, 99),
+			bundle: &Bundle{
+				lowerBlock:              0,
+				upperBlockID:            numToID(99, "a"),
+				firstStreamableBlock:    2,
+				firstStreamableBlockSet: true,
+				chunkSize:               100,
+			},
+			expectComplete: false,
+		},
+		{
+			name:           "beginning at snapshot height",
+			fileListGetter: contiguousBlocksGetter(1234, 1299),
+			bundle: &Bundle{
+				lowerBlock:              1200,
+				upperBlockID:            numToID(1299, "a"),
+				firstStreamableBlock:    1234,
+				firstStreamableBlockSet: true,
+				chunkSize:               100,
+			},
+			expectComplete: true,
+		},
+		{
+			name:           "beginning above a first streamable block set to 0",
+			fileListGetter: contiguousBlocksGetter(2, 99),
+			bundle: &Bundle{
+				lowerBlock:              0,
+				upperBlockID:            numToID(99, "a"),
+				firstStreamableBlockSet: true,
+				chunkSize:               100,
+			},
+			expectComplete: false,
+		},
+		{
+			name:           "beginning at a first streamable block set to 0",
+			fileListGetter: contiguousBlocksGetter(0, 99),
+			bundle: &Bundle{
+				lowerBlock:              0,
+				upperBlockID:            numToID(99, "a"),
+				firstStreamableBlockSet: true,
+				chunkSize:               100,
+			},
+			expectComplete: true,
+		},
+		{
+			name:           "beginning linked to genesis previous ID",
+			fileListGetter: contiguousBlocksGetter(1, 99),
+			bundle: &Bundle{
+				lowerBlock:        0,
+				upperBlockID:      numToID(99, "a"),
+				genesisPreviousID: "ffffffff" + numToID(0, "a"),
+				chunkSize:         100,
+			},
+			expectComplete: true,
+		},
+		{
+			name:           "first streamable block in a later bundle",
+			fileListGetter: contiguousBlocksGetter(1250, 1299),
+			bundle: &Bundle{
+				lowerBlock:              1200,
+				upperBlockID:            numToID(1299, "a"),
+				firstStreamableBlock:    1100,
+				firstStreamableBlockSet: true,
+				chunkSize:               100,
+			},
+			expectComplete: false,
+		},
 		{
 			name:           "incomplete",
 			fileListGetter: contiguousBlocksGetter(100, 180),
@@ -122,3 +192,181 @@ func testBlkFile(num uint64, fork string) *OneBlockFile {
 		num:        num,
 	}
 }
+
+// sparseBlocksGetter links each block to the previous number in `nums`,
+// the first one being linked to `prev`
+func sparseBlocksGetter(prev uint64, nums ...uint64) func() map[string]*OneBlockFile {
+	return func() map[string]*OneBlockFile {
+		f := make(map[string]*OneBlockFile)
+		for _, num := range nums {
+			blk := testBlkFile(num, "a")
+			blk.previousID = numToID(prev, "a")
+			f[blk.id] = blk
+			prev = num
+		}
+		return f
+	}
+}
+
+func TestIsCompleteSparse(t *testing.T) {
+	tests := []struct {
+		name           string
+		fileListGetter func() map[string]*OneBlockFile
+		bundle         *Bundle
+		expectComplete bool
+	}{
+		{
+			name:           "skipped lower boundary linked to merged block",
+			fileListGetter: sparseBlocksGetter(97, 101, 150, 199),
+			bundle: &Bundle{
+				lowerBlock:    100,
+				upperBlockID:  numToID(199, "a"),
+				sparse:        true,
+				mergedTailIDs: map[string]bool{numToID(97, "a"): true},
+			},
+			expectComplete: true,
+		},
+		{
+			name:           "skipped lower boundary not linked",
+			fileListGetter: sparseBlocksGetter(97, 101, 150, 199),
+			bundle: &Bundle{
+				lowerBlock:    100,
+				upperBlockID:  numToID(199, "a"),
+				sparse:        true,
+				mergedTailIDs: map[string]bool{numToID(98, "a"): true},
+			},
+			expectComplete: false,
+		},
+		{
+			name:           "skipped lower boundary without sparse mode",
+			fileListGetter: sparseBlocksGetter(97, 101, 150, 199),
+			bundle: &Bundle{
+				lowerBlock:    100,
+				upperBlockID:  numToID(199, "a"),
+				mergedTailIDs: map[string]bool{numToID(97, "a"): true},
+			},
+			expectComplete: false,
+		},
+		{
+			name:           "every slot skipped",
+			fileListGetter: sparseBlocksGetter(97),
+			bundle: &Bundle{
+				lowerBlock:    100,
+				upperBlockID:  numToID(97, "a"),
+				sparse:        true,
+				mergedTailIDs: map[string]bool{numToID(97, "a"): true},
+			},
+			expectComplete: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := test.bundle
+			b.fileList = test.fileListGetter()
+			assert.Equal(t, test.expectComplete, b.isComplete())
+		})
+	}
+}
+
+func TestTriageSparseUpperBoundary(t *testing.T) {
+	b := NewBundle(100, 100)
+	b.sparse = true
+
+	_, err := b.triage("0000000203-20170701T122141.0-00000203a-00000201a", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "00000201a", b.upperBlockID)
+
+	_, err = b.triage("0000000201-20170701T122141.5-00000201a-00000198a", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "00000198a", b.upperBlockID, "first block above the skipped boundary slot closes the bundle")
+	assert.Equal(t, uint64(201), b.upperBlockNum)
+
+	b.sparse = false
+	b.upperBlockID = ""
+	b.upperBlockTime = time.Time{}
+	_, err = b.triage("0000000201-20170701T122141.5-00000201a-00000198a", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", b.upperBlockID, "only the boundary block closes the bundle in non-sparse mode")
+}
+
+func TestSortedFiles(t *testing.T) {
+	blockTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newFile := func(num uint64, fork string, prevFork string, offset time.Duration) *OneBlockFile {
+		return &OneBlockFile{
+			name:       numToID(num, fork),
+			id:         numToID(num, fork),
+			previousID: numToID(num-1, prevFork),
+			num:        num,
+			blockTime:  blockTime.Add(offset),
+		}
+	}
+
+	b := NewBundle(100, 100)
+	b.upperBlockID = numToID(102, "a")
+	for _, f := range []*OneBlockFile{
+		newFile(100, "a", "a", 0),
+		newFile(101, "b", "a", 0),
+		newFile(101, "a", "a", 0),
+		newFile(102, "a", "a", time.Second),
+		newFile(102, "b", "b", 0),
+	} {
+		b.fileList[f.name] = f
+	}
+
+	ids := func(files []*OneBlockFile) (out []string) {
+		for _, f := range files {
+			out = append(out, f.id)
+		}
+		return
+	}
+
+	b.ordering = OrderByTime
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{
+			numToID(100, "a"),
+			numToID(101, "a"),
+			numToID(101, "b"),
+			numToID(102, "b"),
+			numToID(102, "a"),
+		}, ids(b.sortedFiles()))
+	}
+
+	b.ordering = OrderByNumber
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{
+			numToID(100, "a"),
+			numToID(101, "a"),
+			numToID(101, "b"),
+			numToID(102, "a"),
+			numToID(102, "b"),
+		}, ids(b.sortedFiles()))
+	}
+}
+
+func TestTriageDuplicatesAndLIB(t *testing.T) {
+	b := NewBundle(100, 100)
+
+	// a block already in the bundle from another producer
+	b.fileList["0000000150-20170701T122141.0-00000150a-00000149a-140-mindreader-1"] = &OneBlockFile{
+		name:     "0000000150-20170701T122141.0-00000150a-00000149a-140-mindreader-1",
+		num:      150,
+		id:       "00000150a",
+		producer: "mindreader-1",
+	}
+
+	processed, err := b.triage("0000000150-20170701T122141.5-00000150a-00000149a-140-mindreader-2", nil, nil)
+	require.NoError(t, err)
+	assert.True(t, processed)
+	assert.Len(t, b.fileList, 1)
+	assert.Len(t, b.duplicates, 1)
+	assert.Len(t, b.filenames(), 2)
+
+	_, err = b.triage("0000000200-20170701T122142.0-00000200a-00000199a-180-mindreader-1", nil, nil)
+	require.NoError(t, err)
+	assert.False(t, b.upperBoundIrreversible())
+
+	_, err = b.triage("0000000203-20170701T122143.5-00000203a-00000202a-199-mindreader-1", nil, nil)
+	require.NoError(t, err)
+	assert.True(t, b.upperBoundIrreversible())
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
+)
+
+// downloadCache keeps the payloads of downloaded one-block files in a
+// local directory, keyed by filename, so a restarted merger does not
+// download the files of its current bundle again. The least recently
+// used files are evicted when the directory grows over `maxSize` bytes.
+type downloadCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// newDownloadCache opens the cache directory, creating it if needed, and
+// indexes the files left there by a previous run.
+func newDownloadCache(dir string, maxSize int64) (*downloadCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %w", err)
+	}
+
+	c := &downloadCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, info.Name())) // interrupted write
+			continue
+		}
+		c.entries[info.Name()] = &cacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+
+	return c, nil
+}
+
+func (c *downloadCache) get(filename string) ([]byte, bool) {
+	c.lock.Lock()
+	entry, found := c.entries[filename]
+	if found {
+		entry.lastUsed = time.Now()
+	}
+	c.lock.Unlock()
+
+	if !found {
+		metrics.DownloadCacheMisses.Inc()
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, filename))
+	if err != nil {
+		zlog.Warn("cannot read cached one-block file", zap.String("filename", filename), zap.Error(err))
+		c.remove(filename)
+		metrics.DownloadCacheMisses.Inc()
+		return nil, false
+	}
+
+	metrics.DownloadCacheHits.Inc()
+	return data, true
+}
+
+// put writes the payload to a temporary file renamed into place, so a
+// crash never leaves a truncated entry behind.
+func (c *downloadCache) put(filename string, data []byte) {
+	if err := writeFileAtomic(filepath.Join(c.dir, filename), data); err != nil {
+		zlog.Warn("cannot write one-block file to cache", zap.String("filename", filename), zap.Error(err))
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, found := c.entries[filename]; found {
+		c.size -= entry.size
+	}
+	c.entries[filename] = &cacheEntry{size: int64(len(data)), lastUsed: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+}
+
+func (c *downloadCache) remove(filename string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(filename)
+	metrics.DownloadCacheSize.SetUint64(uint64(c.size))
+}
+
+func (c *downloadCache) removeLocked(filename string) {
+	entry, found := c.entries[filename]
+	if !found {
+		return
+	}
+
+	if err := os.Remove(filepath.Join(c.dir, filename)); err != nil && !os.IsNotExist(err) {
+		zlog.Warn("cannot remove one-block file from cache", zap.String("filename", filename), zap.Error(err))
+	}
+	delete(c.entries, filename)
+	c.size -= entry.size
+}
+
+// evict removes the least recently used entries until the cache fits in
+// `maxSize`, the lock must be held.
+func (c *downloadCache) evict() {
+	if c.size > c.maxSize {
+		filenames := make([]string, 0, len(c.entries))
+		for filename := range c.entries {
+			filenames = append(filenames, filename)
+		}
+		sort.Slice(filenames, func(i, j int) bool {
+			return c.entries[filenames[i]].lastUsed.Before(c.entries[filenames[j]].lastUsed)
+		})
+
+		for _, filename := range filenames {
+			if c.size <= c.maxSize {
+				break
+			}
+			c.removeLocked(filename)
+		}
+	}
+
+	metrics.DownloadCacheSize.SetUint64(uint64(c.size))
+}
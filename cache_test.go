@@ -0,0 +1,60 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := newDownloadCache(dir, 10)
+	require.NoError(t, err)
+
+	_, found := c.get(blk100.filename)
+	assert.False(t, found)
+
+	c.put(blk100.filename, []byte("1234"))
+	c.put(blk101.filename, []byte("5678"))
+
+	data, found := c.get(blk100.filename)
+	require.True(t, found)
+	assert.Equal(t, []byte("1234"), data)
+
+	// blk101 is the least recently used
+	c.put(blk102.filename, []byte("9012"))
+	_, found = c.get(blk101.filename)
+	assert.False(t, found)
+	assert.Equal(t, int64(8), c.size)
+
+	// survives a restart
+	c, err = newDownloadCache(dir, 10)
+	require.NoError(t, err)
+	data, found = c.get(blk102.filename)
+	require.True(t, found)
+	assert.Equal(t, []byte("9012"), data)
+
+	c.remove(blk102.filename)
+	_, found = c.get(blk102.filename)
+	assert.False(t, found)
+}
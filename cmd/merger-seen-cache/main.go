@@ -0,0 +1,101 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command merger-seen-cache inspects the seen blocks cache of a merger,
+// either a local file or the state store given as a URL, like
+// `gs://bucket/merger-state`, when the merger runs with a state store.
+//
+//	merger-seen-cache info <file|url>     prints a summary of the cache
+//	merger-seen-cache dump <file|url>     prints the cache as JSON
+//	merger-seen-cache migrate <file|url>  rewrites a legacy cache in the current format
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/merger"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		usage()
+	}
+
+	command, filename := os.Args[1], os.Args[2]
+	cache, err := load(filename)
+	if err != nil {
+		fail(err)
+	}
+
+	switch command {
+	case "info":
+		blocks := cache.Blocks()
+		fmt.Printf("file:         %s\n", filename)
+		fmt.Printf("highest seen: %d\n", cache.HighestSeen)
+		fmt.Printf("block IDs:    %d\n", cache.Len())
+		if len(blocks) > 0 {
+			fmt.Printf("lowest:       %d\n", blocks[0].Num)
+			fmt.Printf("highest:      %d\n", blocks[len(blocks)-1].Num)
+		}
+
+	case "dump":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(map[string]interface{}{
+			"highest_seen": cache.HighestSeen,
+			"blocks":       cache.Blocks(),
+		})
+
+	case "migrate":
+		err = cache.Save()
+		if err == nil {
+			fmt.Printf("wrote %s in format version %d\n", filename, merger.SeenBlockCacheVersion)
+		}
+
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+// load reads the cache from a local file, or from a state store when
+// `filename` is a store URL.
+func load(filename string) (*merger.SeenBlockCache, error) {
+	if !strings.Contains(filename, "://") {
+		return merger.LoadSeenBlockCache(filename)
+	}
+
+	store, err := dstore.NewSimpleStore(filename)
+	if err != nil {
+		return nil, err
+	}
+	return merger.LoadSeenBlockCacheFromStore(store)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: merger-seen-cache info|dump|migrate <file|state store url>")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ConsistencyPolicy tells what to do when the progress file, the seen
+// cache and the destination store disagree at startup, or when the
+// destination store has a hole.
+type ConsistencyPolicy int
+
+const (
+	// ConsistencyWarn logs the disagreements and starts anyway.
+	ConsistencyWarn ConsistencyPolicy = iota
+	// ConsistencyRefuse refuses to start.
+	ConsistencyRefuse
+	// ConsistencyAutoCorrect starts from the destination head and
+	// resets a seen cache that is ahead of it.
+	ConsistencyAutoCorrect
+)
+
+func ParseConsistencyPolicy(in string) (ConsistencyPolicy, error) {
+	switch in {
+	case "", "warn":
+		return ConsistencyWarn, nil
+	case "refuse":
+		return ConsistencyRefuse, nil
+	case "auto-correct":
+		return ConsistencyAutoCorrect, nil
+	}
+	return 0, fmt.Errorf("unknown consistency policy %q, valid values are \"warn\", \"refuse\" and \"auto-correct\"", in)
+}
+
+func (p ConsistencyPolicy) String() string {
+	switch p {
+	case ConsistencyRefuse:
+		return "refuse"
+	case ConsistencyAutoCorrect:
+		return "auto-correct"
+	}
+	return "warn"
+}
+
+// ConsistencyReport describes the state found at startup.
+type ConsistencyReport struct {
+	RequestedStart  uint64
+	Start           uint64 // after auto-correction
+	ProgressBlock   uint64 // 0 when there is no progress file
+	SeenHighest     uint64 // 0 when the seen cache is empty
+	DestinationNext uint64 // first bundle of the merged range missing from the destination store
+	Issues          []string
+	Notes           []string // like holes below the merged range, the policy does not apply to them
+	Corrected       bool
+}
+
+func (r *ConsistencyReport) fields() []zap.Field {
+	return []zap.Field{
+		zap.Uint64("requested_start", r.RequestedStart),
+		zap.Uint64("start", r.Start),
+		zap.Uint64("progress_block", r.ProgressBlock),
+		zap.Uint64("seen_highest", r.SeenHighest),
+		zap.Uint64("destination_next", r.DestinationNext),
+		zap.Strings("issues", r.Issues),
+		zap.Strings("notes", r.Notes),
+		zap.Bool("corrected", r.Corrected),
+	}
+}
+
+// ReconcileStart compares the block the merger is about to start from
+// with the progress file, the seen cache and the head of the destination
+// store in the range being merged, logs a report and applies `policy`
+// when they disagree. It returns the block to start from, to be given to
+// `SetupBundle`.
+//
+// Holes of the destination store below the range are only reported:
+// they are expected in batch mode, where parallel ranges are merged
+// independently.
+func (m *Merger) ReconcileStart(start, progressBlock uint64, policy ConsistencyPolicy) (uint64, *ConsistencyReport, error) {
+	startBundle := start - start%m.chunkSize
+	destinationNext, err := m.findNextBaseBlockFrom(startBundle)
+	if err != nil {
+		return start, nil, fmt.Errorf("finding destination head: %w", err)
+	}
+
+	report := &ConsistencyReport{
+		RequestedStart:  start,
+		Start:           start,
+		ProgressBlock:   progressBlock,
+		SeenHighest:     m.seenBlocks.HighestSeen,
+		DestinationNext: destinationNext,
+	}
+
+	// what FindNextBaseBlock returns on an empty destination
+	floor := m.minimalBlockNum
+	if firstBundle := m.firstStreamableBlock - m.firstStreamableBlock%m.chunkSize; firstBundle > floor {
+		floor = firstBundle
+	}
+
+	head, err := m.FindNextBaseBlock()
+	var hole *HoleError
+	if err != nil && !errors.As(err, &hole) {
+		return start, nil, fmt.Errorf("finding destination head: %w", err)
+	}
+	if head < startBundle && (head > floor || hole != nil) {
+		report.Notes = append(report.Notes, fmt.Sprintf("destination store has a hole below the range, bundle %d is missing", head))
+	}
+
+	var resetSeenCache bool
+	if progressBlock > destinationNext {
+		report.Issues = append(report.Issues, fmt.Sprintf("progress file is at block %d but the destination store ends before bundle %d", progressBlock, destinationNext))
+	}
+	if report.SeenHighest >= startBundle+m.chunkSize {
+		report.Issues = append(report.Issues, fmt.Sprintf("seen cache has blocks up to %d, past the bundle starting at %d, its blocks would be skipped", report.SeenHighest, startBundle))
+		resetSeenCache = true
+	}
+
+	if len(report.Issues) == 0 {
+		zlog.Info("startup consistency check passed", report.fields()...)
+		return start, report, nil
+	}
+
+	switch policy {
+	case ConsistencyRefuse:
+		zlog.Error("startup consistency check failed, refusing to start", report.fields()...)
+		return start, report, fmt.Errorf("inconsistent startup state: %s", strings.Join(report.Issues, "; "))
+
+	case ConsistencyAutoCorrect:
+		// only moves forward over bundles of the range already merged,
+		// never across a hole
+		if destinationNext > startBundle {
+			report.Start = destinationNext
+		}
+		if resetSeenCache && report.SeenHighest >= report.Start-report.Start%m.chunkSize+m.chunkSize {
+			m.seenBlocks.Reset()
+		}
+		report.Corrected = true
+		zlog.Warn("startup consistency check failed, auto-correcting", report.fields()...)
+		return report.Start, report, nil
+	}
+
+	zlog.Warn("startup consistency check failed, starting anyway", report.fields()...)
+	return start, report, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fullWalkStore walks the whole store whatever the prefix, like a remote
+// store listing many merged files under a short prefix
+type fullWalkStore struct {
+	dstore.Store
+}
+
+func (s fullWalkStore) Walk(ctx context.Context, prefix, ignoreSuffix string, f func(filename string) error) error {
+	return s.Store.Walk(ctx, "", ignoreSuffix, f)
+}
+
+func TestReconcileStart(t *testing.T) {
+	// as left by mergers running in parallel on batch ranges
+	sparseMerged := []string{"0000000100", "0000000200", "0000000500", "0000000600"}
+
+	tests := []struct {
+		name          string
+		merged        []string
+		fullWalk      bool
+		start         uint64
+		progress      uint64
+		seenHighest   uint64
+		policy        ConsistencyPolicy
+		expectStart   uint64
+		expectIssues  int
+		expectNotes   int
+		expectError   bool
+		expectSeenNil bool
+	}{
+		{name: "consistent", merged: []string{"0000000100", "0000000200"}, start: 300, progress: 300, seenHighest: 299, expectStart: 300},
+		{name: "fresh destination", start: 5000, expectStart: 5000},
+		{name: "progress ahead, warn", merged: []string{"0000000100", "0000000200"}, start: 300, progress: 500, expectStart: 300, expectIssues: 1},
+		{name: "progress ahead, refuse", merged: []string{"0000000100", "0000000200"}, start: 300, progress: 500, policy: ConsistencyRefuse, expectStart: 300, expectIssues: 1, expectError: true},
+		{name: "hole below range, auto-correct", merged: []string{"0000000100", "0000000200"}, start: 500, progress: 500, policy: ConsistencyAutoCorrect, expectStart: 500, expectNotes: 1},
+		{name: "sparse destination, warn", merged: sparseMerged, start: 700, progress: 700, seenHighest: 699, expectStart: 700, expectNotes: 1},
+		{name: "sparse destination walked, warn", merged: sparseMerged, fullWalk: true, start: 700, progress: 700, seenHighest: 699, expectStart: 700, expectNotes: 1},
+		{name: "sparse destination walked, refuse", merged: sparseMerged, fullWalk: true, start: 700, progress: 700, policy: ConsistencyRefuse, expectStart: 700, expectNotes: 1},
+		{name: "sparse destination walked, auto-correct", merged: sparseMerged, fullWalk: true, start: 700, progress: 700, policy: ConsistencyAutoCorrect, expectStart: 700, expectNotes: 1},
+		{name: "range of a parallel worker, refuse", merged: sparseMerged, fullWalk: true, start: 300, progress: 300, policy: ConsistencyRefuse, expectStart: 300},
+		{name: "progress ahead in range, auto-correct", merged: sparseMerged, fullWalk: true, start: 500, progress: 900, policy: ConsistencyAutoCorrect, expectStart: 700, expectIssues: 1, expectNotes: 1},
+		{name: "progress ahead across a hole, auto-correct", merged: sparseMerged, fullWalk: true, start: 100, progress: 700, policy: ConsistencyAutoCorrect, expectStart: 300, expectIssues: 1},
+		{name: "seen cache ahead, auto-correct", merged: []string{"0000000100", "0000000200"}, start: 300, seenHighest: 450, policy: ConsistencyAutoCorrect, expectStart: 300, expectIssues: 1, expectSeenNil: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _, multiStore, cleanup := setupMerger(t)
+			defer cleanup()
+			m.chunkSize = 100
+			m.minimalBlockNum = 100
+
+			for _, name := range test.merged {
+				require.NoError(t, multiStore.WriteObject(context.Background(), name, strings.NewReader("merged")))
+			}
+			if test.fullWalk {
+				m.destStore = fullWalkStore{multiStore}
+			}
+			m.seenBlocks.Reset()
+			m.seenBlocks.HighestSeen = test.seenHighest
+
+			start, report, err := m.ReconcileStart(test.start, test.progress, test.policy)
+			if test.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, test.expectStart, start)
+			assert.Len(t, report.Issues, test.expectIssues)
+			assert.Len(t, report.Notes, test.expectNotes)
+			if test.expectSeenNil {
+				assert.Equal(t, uint64(0), m.seenBlocks.HighestSeen)
+			}
+		})
+	}
+}
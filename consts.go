@@ -20,3 +20,26 @@ var ListFilesTimeout = 10 * time.Minute
 var WriteObjectTimeout = 5 * time.Minute
 var GetObjectTimeout = 5 * time.Minute
 var DeleteObjectTimeout = 5 * time.Minute
+var DownloadTimeout = 1 * time.Minute
+
+var DefaultDownloadConcurrency = 64
+var DownloadChunkSize = 64 * 1024
+var DefaultDownloadCacheMaxSize int64 = 1 << 30
+
+var DefaultFirstStreamableBlock uint64 = 2 // EOSIO genesis, used when none is configured
+
+var DefaultListBatchSize = 2000
+var DefaultTimeBetweenFullWalks = 5 * time.Minute
+
+var DefaultUploadRetryBudget = 15 * time.Minute
+var UploadRetryMaxBackoff = 30 * time.Second
+
+var DefaultJanitorConcurrency = 64
+var JanitorInterval = 30 * time.Second
+var JanitorSaveInterval = 10 * time.Second
+var DefaultSweepInterval = 1 * time.Hour
+
+var DefaultForkAlertDepth = 12
+
+var DefaultStallTimeout = 5 * time.Minute
+var StallWebhookTimeout = 10 * time.Second
@@ -0,0 +1,184 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/merger/metrics"
+)
+
+// downloadScheduler runs the downloads of one-block files with at most
+// `concurrency` of them in flight, always starting with the lowest
+// pending block, which is the one a bundle needs first to be merged.
+//
+// Workers are only started while there are pending downloads, so an
+// idle scheduler holds no goroutine and needs no closing.
+type downloadScheduler struct {
+	concurrency int
+
+	lock    sync.Mutex
+	queue   downloadQueue
+	workers int
+}
+
+type downloadJob struct {
+	group    *downloadGroup
+	oneBlock *OneBlockFile
+	run      func()
+}
+
+func newDownloadScheduler(concurrency int) *downloadScheduler {
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+	return &downloadScheduler{concurrency: concurrency}
+}
+
+// schedule queues `run`, which downloads `oneBlock` for `group`.
+func (s *downloadScheduler) schedule(group *downloadGroup, oneBlock *OneBlockFile, run func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	heap.Push(&s.queue, &downloadJob{group: group, oneBlock: oneBlock, run: run})
+	metrics.PendingDownloads.Inc()
+
+	if s.workers < s.concurrency {
+		s.workers++
+		go s.work()
+	}
+}
+
+func (s *downloadScheduler) work() {
+	for {
+		s.lock.Lock()
+		if s.queue.Len() == 0 {
+			s.workers--
+			s.lock.Unlock()
+			return
+		}
+		job := heap.Pop(&s.queue).(*downloadJob)
+		s.lock.Unlock()
+
+		metrics.PendingDownloads.Dec()
+		job.run()
+	}
+}
+
+// cancel removes the queued downloads of `group`, they are done with
+// `err` without running.
+func (s *downloadScheduler) cancel(group *downloadGroup, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	kept := s.queue[:0]
+	for _, job := range s.queue {
+		if job.group != group {
+			kept = append(kept, job)
+			continue
+		}
+		metrics.PendingDownloads.Dec()
+		group.done(err)
+	}
+	for i := len(kept); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = kept
+	heap.Init(&s.queue)
+}
+
+type downloadQueue []*downloadJob
+
+func (q downloadQueue) Len() int { return len(q) }
+func (q downloadQueue) Less(i, j int) bool {
+	if q[i].oneBlock.num != q[j].oneBlock.num {
+		return q[i].oneBlock.num < q[j].oneBlock.num
+	}
+	return q[i].oneBlock.name < q[j].oneBlock.name
+}
+func (q downloadQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *downloadQueue) Push(x interface{}) { *q = append(*q, x.(*downloadJob)) }
+func (q *downloadQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return job
+}
+
+// downloadGroup tracks the downloads of a bundle, like an
+// `errgroup.Group` whose goroutines are run by a `downloadScheduler`.
+type downloadGroup struct {
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+func (g *downloadGroup) add() {
+	g.wg.Add(1)
+}
+
+func (g *downloadGroup) done(err error) {
+	if err != nil {
+		g.errOnce.Do(func() { g.err = err })
+	}
+	g.wg.Done()
+}
+
+// Wait blocks until all downloads are done and returns the first error.
+func (g *downloadGroup) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+// downloadFile reads the one-block file in chunks so a canceled `ctx`
+// aborts the download between chunks. Remote stores also bind their
+// reads to `ctx`, which unblocks a read waiting on the network.
+func downloadFile(ctx context.Context, bf *OneBlockFile, s dstore.Store) error {
+	start := time.Now()
+	out, err := s.OpenObject(ctx, bf.name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buffer := bytes.NewBuffer(nil)
+	chunk := make([]byte, DownloadChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := out.Read(chunk)
+		buffer.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	bf.blk = buffer.Bytes()
+	metrics.DownloadedBytes.AddInt(len(bf.blk))
+	metrics.DownloadDuration.ObserveSince(start)
+	return nil
+}
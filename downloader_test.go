@@ -0,0 +1,165 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadSchedulerPriority(t *testing.T) {
+	s := newDownloadScheduler(1)
+
+	// hold the only worker while jobs are queued
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s.schedule(nil, &OneBlockFile{num: 1}, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var lock sync.Mutex
+	var order []uint64
+	wg := &sync.WaitGroup{}
+	for _, num := range []uint64{105, 102, 104, 101, 103} {
+		num := num
+		wg.Add(1)
+		s.schedule(nil, &OneBlockFile{num: num}, func() {
+			lock.Lock()
+			order = append(order, num)
+			lock.Unlock()
+			wg.Done()
+		})
+	}
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []uint64{101, 102, 103, 104, 105}, order)
+}
+
+func TestDownloadSchedulerConcurrency(t *testing.T) {
+	s := newDownloadScheduler(2)
+
+	var lock sync.Mutex
+	var running, maxRunning int
+	g := &downloadGroup{}
+	for i := uint64(0); i < 20; i++ {
+		g.add()
+		s.schedule(g, &OneBlockFile{num: i}, func() {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			g.done(nil)
+		})
+	}
+
+	require.NoError(t, g.Wait())
+	assert.True(t, maxRunning <= 2, "max running %d", maxRunning)
+}
+
+func TestDownloadSchedulerCancel(t *testing.T) {
+	s := newDownloadScheduler(1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s.schedule(nil, &OneBlockFile{num: 1}, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	abandoned, kept := &downloadGroup{}, &downloadGroup{}
+	var ran []uint64
+	for _, num := range []uint64{101, 102, 103} {
+		num := num
+		g := abandoned
+		if num == 102 {
+			g = kept
+		}
+		g.add()
+		s.schedule(g, &OneBlockFile{num: num}, func() {
+			ran = append(ran, num)
+			g.done(nil)
+		})
+	}
+
+	s.cancel(abandoned, errBundleAbandoned)
+	assert.Equal(t, errBundleAbandoned, abandoned.Wait())
+
+	close(release)
+	require.NoError(t, kept.Wait())
+	assert.Equal(t, []uint64{102}, ran)
+}
+
+func TestBundleAbandonCancelsDownloads(t *testing.T) {
+	store := dstore.NewMockStore(nil)
+	store.SetFile(blk101.filename, []byte("content"))
+
+	b := NewBundle(100, 100)
+	b.downloads = newDownloadScheduler(1)
+	b.terminating = eitherDone(nil, b.abandoned)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	b.downloads.schedule(nil, &OneBlockFile{num: 1}, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	oneBlock, err := parseOneBlockFilename(blk101.filename)
+	require.NoError(t, err)
+	b.addAndDownload(oneBlock, store)
+
+	b.abandon()
+	close(release)
+	assert.Equal(t, errBundleAbandoned, b.downloadWaitGroup.Wait())
+	assert.Nil(t, oneBlock.blk, "queued download never ran")
+
+	select {
+	case <-b.terminating:
+	case <-time.After(time.Second):
+		t.Error("abandoning stops the retries of running downloads")
+	}
+}
+
+func TestDownloadFileCanceled(t *testing.T) {
+	store := dstore.NewMockStore(nil)
+	store.SetFile(blk100.filename, []byte("content"))
+
+	bf := &OneBlockFile{name: blk100.filename, num: 100}
+	require.NoError(t, downloadFile(context.Background(), bf, store))
+	assert.Equal(t, []byte("content"), bf.blk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bf = &OneBlockFile{name: blk100.filename, num: 100}
+	assert.Error(t, downloadFile(ctx, bf, store))
+	assert.Nil(t, bf.blk)
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
+)
+
+// ForkStats describes the blocks of a bundle that are not part of the
+// canonical chain, the one linked from the upper block ID.
+type ForkStats struct {
+	NonCanonicalBlocks int `json:"non_canonical_blocks"`
+	Branches           int `json:"branches"`     // distinct fork branches, counted by their tips
+	DeepestFork        int `json:"deepest_fork"` // number of blocks of the longest branch
+}
+
+func (s ForkStats) fields() []zap.Field {
+	return []zap.Field{
+		zap.Int("non_canonical_blocks", s.NonCanonicalBlocks),
+		zap.Int("fork_branches", s.Branches),
+		zap.Int("deepest_fork", s.DeepestFork),
+	}
+}
+
+// forkStats follows the `previousID` links of the non-canonical blocks
+// of the bundle: each block without a non-canonical child is the tip of
+// a branch, whose depth is the number of non-canonical blocks linked
+// below it.
+func (b *Bundle) forkStats() (stats ForkStats) {
+	canonical := b.canonicalIDs()
+
+	forked := make(map[string]*OneBlockFile)
+	for _, f := range b.fileList {
+		if !canonical[f.id] {
+			forked[f.id] = f
+		}
+	}
+	stats.NonCanonicalBlocks = len(forked)
+
+	hasChild := make(map[string]bool)
+	for _, f := range forked {
+		if _, found := forked[f.previousID]; found {
+			hasChild[f.previousID] = true
+		}
+	}
+
+	for id, tip := range forked {
+		if hasChild[id] {
+			continue
+		}
+		stats.Branches++
+
+		depth := 0
+		for f := tip; f != nil && depth < len(forked); f = forked[f.previousID] {
+			depth++
+		}
+		if depth > stats.DeepestFork {
+			stats.DeepestFork = depth
+		}
+	}
+	return
+}
+
+func (m *Merger) reportForks(b *Bundle, stats ForkStats) {
+	metrics.NonCanonicalBlocks.AddInt(stats.NonCanonicalBlocks)
+	metrics.ForkBranches.AddInt(stats.Branches)
+	metrics.DeepestFork.SetUint64(uint64(stats.DeepestFork))
+
+	if m.forkAlertDepth > 0 && stats.DeepestFork >= m.forkAlertDepth {
+		zlog.Error("ALERT: deep fork observed in bundle", append(stats.fields(), zap.Uint64("lower_block", b.lowerBlock), zap.Int("alert_depth", m.forkAlertDepth))...)
+	}
+}
+
+// BundleManifest describes a merged file, it is written next to it in
+// the manifest store when one is configured.
+type BundleManifest struct {
+	LowerBlock   uint64    `json:"lower_block"`
+	BlockCount   int       `json:"block_count"`
+	TailBlockNum uint64    `json:"tail_block_num"`
+	TailBlockID  string    `json:"tail_block_id"`
+	Forks        ForkStats `json:"forks"`
+	RunID        string    `json:"run_id"`
+	MergedAt     time.Time `json:"merged_at"`
+}
+
+// ManifestFilename returns the name of the manifest of a merged file.
+func ManifestFilename(mergedFilename string) string {
+	return mergedFilename + ".json"
+}
+
+func (m *Merger) writeManifest(b *Bundle, tail *OneBlockFile, stats ForkStats) error {
+	if m.manifestStore == nil {
+		return nil
+	}
+
+	manifest := &BundleManifest{
+		LowerBlock: b.lowerBlock,
+		BlockCount: len(b.fileList),
+		Forks:      stats,
+		RunID:      m.runID,
+		MergedAt:   time.Now().UTC(),
+	}
+	if tail != nil {
+		manifest.TailBlockNum = tail.num
+		manifest.TailBlockID = tail.id
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return m.retryPolicy.Do("manifest", m.Terminating(), func() error {
+		ctx, cancel := m.terminatingContext(WriteObjectTimeout)
+		defer cancel()
+		return m.manifestStore.WriteObject(ctx, ManifestFilename(m.mergedLayout.blockNumToStr(b.lowerBlock)), bytes.NewReader(content))
+	})
+}
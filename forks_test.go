@@ -0,0 +1,116 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forkBlkFile is block `num` of fork `fork`, linked to block `num-1` of fork `prevFork`
+func forkBlkFile(num uint64, fork, prevFork string) *OneBlockFile {
+	blk := testBlkFile(num, fork)
+	blk.id = numToID(num, fork)
+	blk.previousID = numToID(num-1, prevFork)
+	blk.name = blk.id
+	return blk
+}
+
+func TestForkStats(t *testing.T) {
+	tests := []struct {
+		name        string
+		forkBlocks  []*OneBlockFile
+		expectStats ForkStats
+	}{
+		{
+			name: "no fork",
+		},
+		{
+			name: "single forked block",
+			forkBlocks: []*OneBlockFile{
+				forkBlkFile(150, "b", "a"),
+			},
+			expectStats: ForkStats{NonCanonicalBlocks: 1, Branches: 1, DeepestFork: 1},
+		},
+		{
+			name: "two branches",
+			forkBlocks: []*OneBlockFile{
+				forkBlkFile(120, "b", "a"),
+				forkBlkFile(121, "b", "b"),
+				forkBlkFile(122, "b", "b"),
+				forkBlkFile(160, "c", "a"),
+				forkBlkFile(161, "c", "c"),
+			},
+			expectStats: ForkStats{NonCanonicalBlocks: 5, Branches: 2, DeepestFork: 3},
+		},
+		{
+			name: "branch forking from a fork",
+			forkBlocks: []*OneBlockFile{
+				forkBlkFile(120, "b", "a"),
+				forkBlkFile(121, "b", "b"),
+				forkBlkFile(122, "b", "b"),
+				forkBlkFile(122, "c", "b"),
+				forkBlkFile(123, "c", "c"),
+			},
+			expectStats: ForkStats{NonCanonicalBlocks: 5, Branches: 2, DeepestFork: 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBundle(100, 100)
+			b.fileList = contiguousBlocksGetter(100, 199)()
+			b.upperBlockID = numToID(199, "a")
+			for _, blk := range test.forkBlocks {
+				b.fileList[blk.name] = blk
+			}
+
+			assert.Equal(t, test.expectStats, b.forkStats())
+			assert.Equal(t, numToID(199, "a"), b.tailFile().id)
+		})
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	var written []byte
+	store := dstore.NewMockStore(func(base string, f io.Reader) (err error) {
+		assert.Equal(t, "0000000100.json", base)
+		written, err = ioutil.ReadAll(f)
+		return
+	})
+
+	m := NewMerger(nil, nil, 0, 0, "", false, "", 0, 100, "", WithManifestStore(store))
+	b := NewBundle(100, 100)
+	b.fileList = contiguousBlocksGetter(100, 199)()
+	b.upperBlockID = numToID(199, "a")
+
+	stats := ForkStats{NonCanonicalBlocks: 1, Branches: 1, DeepestFork: 1}
+	require.NoError(t, m.writeManifest(b, b.tailFile(), stats))
+
+	manifest := &BundleManifest{}
+	require.NoError(t, json.Unmarshal(written, manifest))
+	assert.Equal(t, uint64(100), manifest.LowerBlock)
+	assert.Equal(t, 100, manifest.BlockCount)
+	assert.Equal(t, uint64(199), manifest.TailBlockNum)
+	assert.Equal(t, numToID(199, "a"), manifest.TailBlockID)
+	assert.Equal(t, stats, manifest.Forks)
+	assert.Equal(t, m.RunID(), manifest.RunID)
+}
@@ -12,11 +12,11 @@ require (
 	github.com/dfuse-io/logging v0.0.0-20200407175011-14021b7a79af
 	github.com/dfuse-io/pbgo v0.0.6-0.20200602201455-99986ef5a09d
 	github.com/dfuse-io/shutter v1.4.1-0.20200319040708-c809eec458e6
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.14.0
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
-	gopkg.in/olivere/elastic.v3 v3.0.75
+	google.golang.org/grpc v1.26.0
 	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
 
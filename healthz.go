@@ -16,13 +16,162 @@ package merger
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dfuse-io/merger/metrics"
 	pbhealth "github.com/dfuse-io/pbgo/grpc/health/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// HealthReasonKey is the gRPC trailer holding the reasons of a
+// `NOT_SERVING` health check, and HealthStallKey the one holding the
+// JSON `StallReport` when the bundle is stalled.
+const (
+	HealthReasonKey = "merger-health-reason"
+	HealthStallKey  = "merger-stall"
+)
+
+// Codes of the conditions making the merger unhealthy, used as the
+// `reason` label of the `merger_unhealthy` metric.
+const (
+	unhealthyNotListed      = "not_listed"
+	unhealthyHeadDrift      = "head_drift"
+	unhealthyNoNewFiles     = "no_new_files"
+	unhealthyUploadRetrying = "upload_retrying"
+	unhealthyHole           = "hole"
+)
+
+var unhealthyCodes = []string{unhealthyNotListed, unhealthyHeadDrift, unhealthyNoNewFiles, unhealthyUploadRetrying, unhealthyHole}
+
+// healthState is updated by the merging loop and read by health checks.
+type healthState struct {
+	lock sync.Mutex
+
+	listed         bool            // a listing of the source store completed
+	lastListing    map[string]bool // files of the previous listing
+	headBlockTime  time.Time       // time of the most recent block listed
+	lastNewFile    time.Time       // when new one-block files were last listed
+	uploadRetrying bool
+	holeInBundle   bool // the bundle cannot complete because blocks are missing below its upper bound
+	bundleLower    uint64
+	stall          *StallReport // set once the hole blocks the bundle for longer than the stall timeout
+}
+
 func (m *Merger) Check(ctx context.Context, in *pbhealth.HealthCheckRequest) (*pbhealth.HealthCheckResponse, error) {
 	status := pbhealth.HealthCheckResponse_SERVING
+
+	if reasons := m.unhealthyReasons(time.Now()); len(reasons) > 0 {
+		status = pbhealth.HealthCheckResponse_NOT_SERVING
+		trailer := metadata.Pairs(HealthReasonKey, strings.Join(reasons, "; "))
+		if stall := m.StallReport(); stall != nil {
+			if content, err := json.Marshal(stall); err == nil {
+				trailer.Set(HealthStallKey, string(content))
+			}
+		}
+		_ = grpc.SetTrailer(ctx, trailer)
+	}
+
 	return &pbhealth.HealthCheckResponse{
 		Status: status,
 	}, nil
 }
+
+// unhealthyReasons describes every condition making the merger
+// unhealthy, and reports them in metrics.
+func (m *Merger) unhealthyReasons(now time.Time) (reasons []string) {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	h := &m.health
+
+	failing := map[string]string{}
+	if !h.listed {
+		failing[unhealthyNotListed] = "first listing of the source store not completed"
+	}
+	if m.maxHeadDrift > 0 && m.liveMode && !h.headBlockTime.IsZero() {
+		if drift := now.Sub(h.headBlockTime); drift > m.maxHeadDrift {
+			failing[unhealthyHeadDrift] = fmt.Sprintf("head block drift of %s exceeds %s", drift.Round(time.Second), m.maxHeadDrift)
+		}
+	}
+	if m.maxTimeWithoutNewFiles > 0 && !h.lastNewFile.IsZero() {
+		if since := now.Sub(h.lastNewFile); since > m.maxTimeWithoutNewFiles {
+			failing[unhealthyNoNewFiles] = fmt.Sprintf("no new one-block files for %s", since.Round(time.Second))
+		}
+	}
+	if h.uploadRetrying {
+		failing[unhealthyUploadRetrying] = "uploads of merged files are retrying"
+	}
+	if h.stall != nil {
+		failing[unhealthyHole] = h.stall.summary(now)
+	} else if h.holeInBundle {
+		failing[unhealthyHole] = fmt.Sprintf("hole in one-block files blocks bundle %d", h.bundleLower)
+	}
+
+	for _, code := range unhealthyCodes {
+		if reason, found := failing[code]; found {
+			reasons = append(reasons, reason)
+			metrics.Unhealthy.SetUint64(1, code)
+		} else {
+			metrics.Unhealthy.SetUint64(0, code)
+		}
+	}
+	return
+}
+
+// setUploadRetrying is called from within the upload, while the merge
+// loop is blocked, so it reports the health itself.
+func (m *Merger) setUploadRetrying(retrying bool) {
+	m.health.lock.Lock()
+	m.health.uploadRetrying = retrying
+	m.health.lock.Unlock()
+
+	m.reportHealth()
+}
+
+// setListed records a completed listing of the files not merged yet,
+// they are new when the previous listing did not have them.
+func (m *Merger) setListed(filenames []string) {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+
+	listing := make(map[string]bool, len(filenames))
+	newFiles := !m.health.listed
+	for _, filename := range filenames {
+		listing[filename] = true
+		if !m.health.lastListing[filename] {
+			newFiles = true
+		}
+	}
+	if newFiles {
+		m.health.lastNewFile = time.Now()
+	}
+	m.health.lastListing = listing
+	m.health.listed = true
+}
+
+// reportHealth updates the `merger_unhealthy` metric from the merging
+// loop, so it does not depend on health checks being polled.
+func (m *Merger) reportHealth() {
+	m.unhealthyReasons(time.Now())
+}
+
+func (m *Merger) setHeadBlockTime(blockTime time.Time) {
+	metrics.HeadBlockTimeDrift.SetBlockTime(blockTime)
+
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	if blockTime.After(m.health.headBlockTime) {
+		m.health.headBlockTime = blockTime
+	}
+}
+
+func (m *Merger) setHoleInBundle(hole bool, bundleLower uint64) {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	m.health.holeInBundle = hole
+	m.health.bundleLower = bundleLower
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pbhealth "github.com/dfuse-io/pbgo/grpc/health/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	m := NewMerger(nil, nil, 0, 0, "", false, "", 0, 100, "")
+
+	resp, err := m.Check(context.Background(), &pbhealth.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, pbhealth.HealthCheckResponse_NOT_SERVING, resp.Status, "not ready before the first listing")
+
+	m.setListed(nil)
+	resp, err = m.Check(context.Background(), &pbhealth.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, pbhealth.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestUnhealthyReasons(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		liveMode      bool
+		update        func(m *Merger)
+		expectReasons []string
+	}{
+		{
+			name:          "not listed",
+			update:        func(m *Merger) {},
+			expectReasons: []string{"first listing of the source store not completed"},
+		},
+		{
+			name:   "healthy",
+			update: func(m *Merger) { m.setListed(nil) },
+		},
+		{
+			name:     "head drift in live mode",
+			liveMode: true,
+			update: func(m *Merger) {
+				m.setListed(nil)
+				m.setHeadBlockTime(now.Add(-2 * time.Minute))
+			},
+			expectReasons: []string{"head block drift of 2m0s exceeds 1m0s"},
+		},
+		{
+			name: "head drift ignored when reprocessing",
+			update: func(m *Merger) {
+				m.setListed(nil)
+				m.setHeadBlockTime(now.Add(-2 * time.Minute))
+			},
+		},
+		{
+			name: "no new files",
+			update: func(m *Merger) {
+				m.setListed(nil)
+				m.health.lastNewFile = now.Add(-10 * time.Minute)
+			},
+			expectReasons: []string{"no new one-block files for 10m0s"},
+		},
+		{
+			name: "only files of the previous listing",
+			update: func(m *Merger) {
+				m.setListed([]string{blk100.filename})
+				m.health.lastNewFile = now.Add(-10 * time.Minute)
+				m.setListed([]string{blk100.filename})
+			},
+			expectReasons: []string{"no new one-block files for 10m0s"},
+		},
+		{
+			name: "new files listed",
+			update: func(m *Merger) {
+				m.setListed([]string{blk100.filename})
+				m.health.lastNewFile = now.Add(-10 * time.Minute)
+				m.setListed([]string{blk100.filename, blk101.filename})
+			},
+		},
+		{
+			name: "upload retrying and hole",
+			update: func(m *Merger) {
+				m.setListed(nil)
+				m.setUploadRetrying(true)
+				m.setHoleInBundle(true, 200)
+			},
+			expectReasons: []string{"uploads of merged files are retrying", "hole in one-block files blocks bundle 200"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMerger(nil, nil, 0, 0, "", false, "", 0, 100, "", WithHealthThresholds(time.Minute, 5*time.Minute))
+			m.liveMode = test.liveMode
+			test.update(m)
+
+			assert.Equal(t, test.expectReasons, m.unhealthyReasons(now))
+		})
+	}
+}
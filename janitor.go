@@ -0,0 +1,249 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
+)
+
+// janitor deletes one-block files from the source store, once the
+// retention policy lets them go. Files that are retained or cannot be
+// deleted stay pending and are checked again on every pass, across
+// restarts when `stateFile` is set.
+type janitor struct {
+	store       dstore.Store
+	retryPolicy RetryPolicy
+	retention   RetentionPolicy
+	concurrency int
+	stateFile   string // where pending deletions are persisted, kept in memory only when empty
+
+	lock     sync.Mutex
+	pending  map[string]bool
+	head     uint64 // highest merged block, for block-based retention
+	dirty    bool   // pending deletions changed since the last save
+	lastSave time.Time
+
+	passLock sync.Mutex // one pass at a time
+	wake     chan struct{}
+}
+
+type janitorState struct {
+	Pending []string `json:"pending"`
+}
+
+func newJanitor(store dstore.Store, retryPolicy RetryPolicy, retention RetentionPolicy, concurrency int, stateFile string) *janitor {
+	if concurrency <= 0 {
+		concurrency = DefaultJanitorConcurrency
+	}
+
+	j := &janitor{
+		store:       store,
+		retryPolicy: retryPolicy,
+		retention:   retention,
+		concurrency: concurrency,
+		stateFile:   stateFile,
+		pending:     make(map[string]bool),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if stateFile != "" {
+		if err := j.load(); err != nil && !os.IsNotExist(err) {
+			zlog.Warn("cannot load pending deletions", zap.String("filename", stateFile), zap.Error(err))
+		}
+	}
+	metrics.PendingDeletions.SetUint64(uint64(len(j.pending)))
+
+	return j
+}
+
+// enqueue marks files for deletion and wakes the background pass, it
+// never waits for the deletions.
+func (j *janitor) enqueue(filenames ...string) {
+	if len(filenames) == 0 {
+		return
+	}
+
+	j.lock.Lock()
+	var added bool
+	for _, filename := range filenames {
+		if !j.pending[filename] {
+			j.pending[filename] = true
+			added = true
+		}
+	}
+	if added {
+		j.dirty = true
+		metrics.PendingDeletions.SetUint64(uint64(len(j.pending)))
+	}
+	j.lock.Unlock()
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setHead records the highest merged block.
+func (j *janitor) setHead(num uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if num > j.head {
+		j.head = num
+	}
+}
+
+// run does a pass every `JanitorInterval`, or as soon as files are
+// enqueued, until `terminating` is closed.
+func (j *janitor) run(terminating <-chan struct{}) {
+	for {
+		select {
+		case <-terminating:
+			j.lock.Lock()
+			j.saveLocked(true)
+			j.lock.Unlock()
+			return
+		case <-j.wake:
+		case <-time.After(JanitorInterval):
+		}
+		j.deletePending(terminating)
+	}
+}
+
+// deletePending tries once to delete every pending file that is not
+// retained anymore, with bounded concurrency. Deleting a file that is
+// already gone counts as a success.
+func (j *janitor) deletePending(terminating <-chan struct{}) {
+	j.passLock.Lock()
+	defer j.passLock.Unlock()
+
+	now := time.Now()
+	j.lock.Lock()
+	filenames := make([]string, 0, len(j.pending))
+	for filename := range j.pending {
+		if j.retention.expired(filename, j.head, now) {
+			filenames = append(filenames, filename)
+		}
+	}
+	j.lock.Unlock()
+
+	if len(filenames) == 0 {
+		return
+	}
+	sort.Strings(filenames)
+
+	zlog.Debug("deleting one-block files", zap.Int("count", len(filenames)), zap.String("first_file", filenames[0]))
+	eg := llerrgroup.New(j.concurrency)
+	for _, filename := range filenames {
+		if eg.Stop() {
+			break
+		}
+
+		f := filename
+		eg.Go(func() error {
+			t0 := time.Now()
+			err := j.retryPolicy.Do("delete", terminating, func() error {
+				ctx, cancel := contextWithCancelOn(terminating, DeleteObjectTimeout)
+				defer cancel()
+
+				if err := j.retention.archive(ctx, j.store, f); err != nil {
+					return err
+				}
+				return j.store.DeleteObject(ctx, f)
+			})
+			if err != nil && !IsNotExistError(err) {
+				zlog.Warn("cannot delete one-block file, will retry", zap.String("filename", f), zap.Error(err))
+				metrics.FailedDeletions.Inc()
+				return nil
+			}
+			metrics.DeletedFiles.Inc()
+			metrics.DeleteDuration.ObserveSince(t0)
+
+			j.lock.Lock()
+			delete(j.pending, f)
+			j.dirty = true
+			j.lock.Unlock()
+			return nil
+		})
+	}
+	eg.Wait()
+
+	j.lock.Lock()
+	j.saveLocked(false)
+	j.lock.Unlock()
+}
+
+func (j *janitor) pendingCount() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.pending)
+}
+
+func (j *janitor) load() error {
+	content, err := ioutil.ReadFile(j.stateFile)
+	if err != nil {
+		return err
+	}
+
+	var state janitorState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+
+	for _, filename := range state.Pending {
+		j.pending[filename] = true
+	}
+	zlog.Info("loaded pending deletions", zap.String("filename", j.stateFile), zap.Int("count", len(j.pending)))
+	return nil
+}
+
+// saveLocked persists the pending deletions when they changed, at most
+// every `JanitorSaveInterval` unless `force` is set, as the whole set is
+// rewritten. Deletions lost by a crash in between are found again by
+// the next listings. The lock must be held.
+func (j *janitor) saveLocked(force bool) {
+	metrics.PendingDeletions.SetUint64(uint64(len(j.pending)))
+	if j.stateFile == "" || !j.dirty {
+		return
+	}
+	if !force && time.Since(j.lastSave) < JanitorSaveInterval {
+		return
+	}
+	j.dirty = false
+	j.lastSave = time.Now()
+
+	state := janitorState{Pending: make([]string, 0, len(j.pending))}
+	for filename := range j.pending {
+		state.Pending = append(state.Pending, filename)
+	}
+	sort.Strings(state.Pending)
+
+	content, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(j.stateFile, content)
+	}
+	if err != nil {
+		zlog.Warn("cannot save pending deletions", zap.String("filename", j.stateFile), zap.Error(err))
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingDeleteStore struct {
+	dstore.Store
+	failing map[string]bool
+}
+
+func (s *failingDeleteStore) DeleteObject(ctx context.Context, base string) error {
+	if s.failing[base] {
+		return fmt.Errorf("cannot delete %s", base)
+	}
+	return s.Store.DeleteObject(ctx, base)
+}
+
+func TestJanitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "pending.json")
+
+	mock := dstore.NewMockStore(nil)
+	mock.SetFile(blk100.filename, []byte("100"))
+	mock.SetFile(blk101.filename, []byte("101"))
+	store := &failingDeleteStore{Store: mock, failing: map[string]bool{blk101.filename: true}}
+
+	policy := RetryPolicy{Attempts: 1}
+	j := newJanitor(store, policy, RetentionPolicy{}, 1, stateFile)
+	j.enqueue(blk100.filename, blk101.filename)
+	j.deletePending(nil)
+
+	exists, err := mock.FileExists(context.Background(), blk100.filename)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 1, j.pendingCount())
+
+	// pending deletions survive a restart
+	store.failing = nil
+	j = newJanitor(store, policy, RetentionPolicy{}, 1, stateFile)
+	require.Equal(t, 1, j.pendingCount())
+
+	j.deletePending(nil)
+	assert.Equal(t, 0, j.pendingCount())
+	exists, err = mock.FileExists(context.Background(), blk101.filename)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	j = newJanitor(store, policy, RetentionPolicy{}, 1, stateFile)
+	assert.Equal(t, 0, j.pendingCount())
+}
+
+func TestJanitorMissingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := dstore.NewLocalStore(dir, "", "", false)
+	require.NoError(t, err)
+
+	j := newJanitor(store, RetryPolicy{Attempts: 1}, RetentionPolicy{}, 1, "")
+	j.enqueue(blk100.filename)
+	j.deletePending(nil)
+	assert.Equal(t, 0, j.pendingCount(), "already gone counts as deleted")
+}
+
+func TestJanitorSaveDebounced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "pending.json")
+
+	mock := dstore.NewMockStore(nil)
+	store := &failingDeleteStore{Store: mock, failing: map[string]bool{blk100.filename: true, blk101.filename: true}}
+	policy := RetryPolicy{Attempts: 1}
+
+	j := newJanitor(store, policy, RetentionPolicy{}, 1, stateFile)
+	j.enqueue(blk100.filename)
+	_, err = os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err), "enqueue does not write the state")
+
+	j.deletePending(nil)
+	j.enqueue(blk101.filename)
+	j.deletePending(nil)
+	assert.Equal(t, 1, newJanitor(store, policy, RetentionPolicy{}, 1, stateFile).pendingCount(), "saved at most once per interval")
+
+	terminating := make(chan struct{})
+	close(terminating)
+	j.run(terminating)
+	assert.Equal(t, 2, newJanitor(store, policy, RetentionPolicy{}, 1, stateFile).pendingCount(), "saved when terminating")
+}
+
+func TestJanitorRetention(t *testing.T) {
+	mock := dstore.NewMockStore(nil)
+	mock.SetFile(blk100.filename, []byte("100"))
+	mock.SetFile(blk101.filename, []byte("101"))
+
+	j := newJanitor(mock, RetryPolicy{Attempts: 1}, RetentionPolicy{Mode: RetainBlocks, KeepBlocks: 1}, 1, "")
+	j.setHead(100)
+	j.enqueue(blk100.filename, blk101.filename)
+	j.deletePending(nil)
+	assert.Equal(t, 2, j.pendingCount())
+
+	j.setHead(101)
+	j.deletePending(nil)
+	assert.Equal(t, 1, j.pendingCount())
+	exists, err := mock.FileExists(context.Background(), blk100.filename)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	var archived []string
+	archive := dstore.NewMockStore(func(base string, f io.Reader) error {
+		archived = append(archived, base)
+		return nil
+	})
+	j = newJanitor(mock, RetryPolicy{Attempts: 1}, RetentionPolicy{Mode: RetainArchive, ArchiveStore: archive}, 1, "")
+	j.enqueue(blk101.filename)
+	j.deletePending(nil)
+	assert.Equal(t, 0, j.pendingCount())
+
+	exists, err = mock.FileExists(context.Background(), blk101.filename)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []string{blk101.filename}, archived)
+}
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	// blk100 was produced on 1970-01-17
+	now := time.Date(1970, 1, 18, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		head   uint64
+		expect bool
+	}{
+		{name: "delete", policy: RetentionPolicy{}, head: 0, expect: true},
+		{name: "archive", policy: RetentionPolicy{Mode: RetainArchive}, head: 0, expect: true},
+		{name: "within kept blocks", policy: RetentionPolicy{Mode: RetainBlocks, KeepBlocks: 10}, head: 109, expect: false},
+		{name: "past kept blocks", policy: RetentionPolicy{Mode: RetainBlocks, KeepBlocks: 10}, head: 110, expect: true},
+		{name: "within kept duration", policy: RetentionPolicy{Mode: RetainDuration, KeepDuration: 48 * time.Hour}, expect: false},
+		{name: "past kept duration", policy: RetentionPolicy{Mode: RetainDuration, KeepDuration: time.Hour}, expect: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, test.policy.expired(blk100.filename, test.head, now))
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mergePhase is the last step completed while merging a bundle.
+type mergePhase int
+
+const (
+	phaseDownloaded mergePhase = iota
+	phaseUploaded
+	phaseSeenCacheUpdated
+	phaseDeleted // deletions handed to the janitor, not necessarily done
+)
+
+var mergePhaseNames = []string{"downloaded", "uploaded", "seen_cache_updated", "deleted"}
+
+func (p mergePhase) String() string {
+	if int(p) < len(mergePhaseNames) {
+		return mergePhaseNames[p]
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+func (p mergePhase) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *mergePhase) UnmarshalText(text []byte) error {
+	for i, name := range mergePhaseNames {
+		if name == string(text) {
+			*p = mergePhase(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown merge phase %q", string(text))
+}
+
+type journalEntry struct {
+	LowerBlock uint64     `json:"lower_block"`
+	Phase      mergePhase `json:"phase"`
+	Filenames  []string   `json:"filenames"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// mergeJournal records the progress of the bundle being merged, so a
+// merger restarting after a crash finishes the merge where it stopped
+// instead of rediscovering its state. A nil journal records nothing.
+type mergeJournal struct {
+	filename string
+}
+
+func newMergeJournal(filename string) *mergeJournal {
+	if filename == "" {
+		return nil
+	}
+	return &mergeJournal{filename: filename}
+}
+
+func (j *mergeJournal) record(lowerBlock uint64, phase mergePhase, filenames []string) {
+	if j == nil {
+		return
+	}
+
+	content, err := json.Marshal(&journalEntry{
+		LowerBlock: lowerBlock,
+		Phase:      phase,
+		Filenames:  filenames,
+		UpdatedAt:  time.Now().UTC(),
+	})
+	if err == nil {
+		err = writeFileAtomic(j.filename, content)
+	}
+	if err != nil {
+		zlog.Warn("cannot write merge journal", zap.String("filename", j.filename), zap.Stringer("phase", phase), zap.Error(err))
+	}
+}
+
+// load returns the last recorded entry, or nil when there is none.
+func (j *mergeJournal) load() (*journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(j.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &journalEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("decoding merge journal %q: %w", j.filename, err)
+	}
+	return entry, nil
+}
+
+// recoverFromJournal finishes the merge interrupted by a previous run:
+// once its merged file is known to be uploaded, its one-block files are
+// added to the seen cache and deleted, and the merger moves on to the
+// next bundle instead of uploading it again.
+func (m *Merger) recoverFromJournal() error {
+	entry, err := m.journal.load()
+	if err != nil || entry == nil {
+		return err
+	}
+
+	if entry.Phase == phaseDeleted {
+		// the deletions were only queued, a crash may have lost them,
+		// deleting files already gone counts as a success
+		m.janitor.setHead(entry.LowerBlock + m.chunkSize - 1)
+		m.janitor.enqueue(entry.Filenames...)
+		return nil
+	}
+
+	if entry.Phase == phaseDownloaded {
+		// the crash may have happened right after the upload
+		ctx, cancel := context.WithTimeout(context.Background(), GetObjectTimeout)
+		defer cancel()
+
+		exists, err := m.destStore.FileExists(ctx, m.mergedLayout.blockNumToStr(entry.LowerBlock))
+		if err != nil {
+			return fmt.Errorf("checking merged file of interrupted bundle %d: %w", entry.LowerBlock, err)
+		}
+		if !exists {
+			zlog.Info("interrupted bundle was not uploaded, merging it again", zap.Uint64("lower_block", entry.LowerBlock))
+			return nil
+		}
+	}
+
+	zlog.Info("finishing interrupted merge", zap.Uint64("lower_block", entry.LowerBlock), zap.Stringer("phase", entry.Phase), zap.Int("file_count", len(entry.Filenames)))
+
+	if entry.Phase < phaseSeenCacheUpdated {
+		for _, filename := range entry.Filenames {
+			m.seenBlocks.Add(filename)
+		}
+		if err := m.seenBlocks.Save(); err != nil {
+			zlog.Error("cannot save SeenBlockCache", zap.Stringer("filename", m.seenBlocks.file), zap.Error(err))
+		}
+		m.journal.record(entry.LowerBlock, phaseSeenCacheUpdated, entry.Filenames)
+	}
+
+	m.janitor.setHead(entry.LowerBlock + m.chunkSize - 1)
+	m.janitor.enqueue(entry.Filenames...)
+	m.journal.record(entry.LowerBlock, phaseDeleted, entry.Filenames)
+
+	if m.bundle != nil && m.bundle.lowerBlock == entry.LowerBlock {
+		m.bundle.abandon()
+		m.bundle = m.newBundle(entry.LowerBlock + m.chunkSize)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverFromJournal(t *testing.T) {
+	tests := []struct {
+		name           string
+		phase          mergePhase
+		mergedUploaded bool
+		expectRecover  bool
+		expectDeleted  bool
+	}{
+		{name: "downloaded, not uploaded", phase: phaseDownloaded},
+		{name: "downloaded, crashed after upload", phase: phaseDownloaded, mergedUploaded: true, expectRecover: true, expectDeleted: true},
+		{name: "uploaded", phase: phaseUploaded, mergedUploaded: true, expectRecover: true, expectDeleted: true},
+		{name: "seen cache updated", phase: phaseSeenCacheUpdated, mergedUploaded: true, expectRecover: true, expectDeleted: true},
+		{name: "deletions queued, crashed before they ran", phase: phaseDeleted, mergedUploaded: true, expectDeleted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, oneStore, multiStore, cleanup := setupMerger(t)
+			defer cleanup()
+
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			m.chunkSize = 100
+			m.seenBlocks.Reset()
+			m.seenBlocks.file = newLocalStateFile(filepath.Join(dir, "seen.json"))
+			m.journal = newMergeJournal(filepath.Join(dir, "journal.json"))
+
+			filenames := []string{blk100.filename, blk101.filename}
+			for _, filename := range filenames {
+				writeOneBlockFile(testBlockForFile(filename), filename, oneStore)
+			}
+			if test.mergedUploaded {
+				require.NoError(t, multiStore.WriteObject(context.Background(), "0000000100", strings.NewReader("merged")))
+			}
+			m.journal.record(100, test.phase, filenames)
+
+			require.NoError(t, m.recoverFromJournal())
+			m.janitor.deletePending(nil)
+
+			exists, err := oneStore.FileExists(context.Background(), blk100.filename)
+			require.NoError(t, err)
+
+			entry, err := m.journal.load()
+			require.NoError(t, err)
+
+			assert.Equal(t, !test.expectDeleted, exists)
+			if test.expectRecover {
+				if test.phase < phaseSeenCacheUpdated {
+					assert.True(t, m.seenBlocks.SeenBefore(blk101.filename))
+				}
+				assert.Equal(t, uint64(200), m.bundle.lowerBlock)
+				assert.Equal(t, phaseDeleted, entry.Phase)
+			} else {
+				assert.False(t, m.seenBlocks.SeenBefore(blk101.filename))
+				assert.Equal(t, uint64(100), m.bundle.lowerBlock)
+				assert.Equal(t, test.phase, entry.Phase)
+			}
+		})
+	}
+}
@@ -18,13 +18,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/storage"
-	"github.com/abourget/llerrgroup"
 	"github.com/dfuse-io/bstream"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	pbmerge "github.com/dfuse-io/pbgo/dfuse/merger/v1"
@@ -43,7 +41,10 @@ type Merger struct {
 	chunkSize               uint64
 	grpcListenAddr          string
 	seenBlocks              *SeenBlockCache
-	progressFilename        string
+	progress                *stateFile // nil when progress is not recorded
+	runID                   string
+	startedAt               time.Time
+	rangeStart              uint64
 	liveMode                bool
 	minimalBlockNum         uint64
 	stopBlockNum            uint64
@@ -53,6 +54,251 @@ type Merger struct {
 
 	bundle     *Bundle // currently managed bundle
 	bundleLock *sync.Mutex
+
+	watchSource          bool
+	timeBetweenFullWalks time.Duration // only used when watching the source store
+	watcher              *sourceWatcher
+	lastFullWalk         time.Time
+	watchedFiles         []string // reported by the watcher but not part of a bundle yet
+
+	listBatchSize    int    // maximum number of good files returned by a single listing
+	listResumeAfter  string // set when the last listing was cut short by `listBatchSize`
+	listResumeLayout FilenameLayout
+
+	sparse bool // chain can skip block numbers
+
+	firstStreamableBlock    uint64
+	firstStreamableBlockSet bool
+	genesisPreviousID       string
+
+	ordering BlockOrdering
+
+	oneBlockLayout FilenameLayout // used to compute listing prefixes in the source store
+	mergedLayout   FilenameLayout // used to name merged files
+
+	quarantineStore            dstore.Store    // receives one-block files that cannot be read or validated
+	quarantineAnnotationsStore dstore.Store    // receives a text file describing the error of each quarantined file
+	quarantined                map[string]bool // quarantined filenames, skipped by listings while their deletion is pending
+
+	retryPolicy       RetryPolicy
+	downloads         *downloadScheduler
+	cache             *downloadCache
+	uploadRetryBudget time.Duration // time after which a failing upload of a merged file terminates the merger
+
+	janitor              *janitor
+	pendingDeletionsFile string
+	journal              *mergeJournal // records the phases of the bundle being merged, nil when disabled
+	retention            RetentionPolicy
+	deleteConcurrency    int
+	sweepInterval        time.Duration // time between full walks of the source store for leftover files, with deleteBlocksBefore
+	lastSweep            time.Time
+	sweepResuming        bool // the current listing continues a sweep cut short
+
+	manifestStore  dstore.Store // receives a manifest for each merged file, optional
+	forkAlertDepth int          // depth from which a fork is logged as an alert, 0 disables
+
+	stallTimeout    time.Duration // time a hole blocks the bundle before it is reported as stalled, 0 disables
+	stallWebhookURL string        // receives stall reports as JSON, optional
+	stallStart      time.Time     // when a hole started blocking the bundle, zero when there is none
+	stallBundle     uint64
+	stallNotified   bool
+
+	health                 healthState
+	maxHeadDrift           time.Duration // head drift over which the merger is unhealthy in live mode, 0 disables
+	maxTimeWithoutNewFiles time.Duration // time without new one-block files after which the merger is unhealthy, 0 disables
+}
+
+type Option func(m *Merger)
+
+// WithSparseChain is used for chains where block numbers can be
+// skipped. Bundles are then considered complete when their blocks link
+// to an already merged block, and closed by the first block at or
+// above the next bundle boundary.
+func WithSparseChain() Option {
+	return func(m *Merger) {
+		m.sparse = true
+	}
+}
+
+// WithFirstStreamableBlock sets the first block of the chain, in place
+// of `DefaultFirstStreamableBlock`, so that the bundle containing it is
+// considered complete without any block below it. When the previous ID
+// of that block is known, it can be given as `genesisPreviousID` so a
+// chain linked to it also completes the first bundle.
+func WithFirstStreamableBlock(num uint64, genesisPreviousID string) Option {
+	return func(m *Merger) {
+		m.firstStreamableBlock = num
+		m.firstStreamableBlockSet = true
+		m.genesisPreviousID = genesisPreviousID
+	}
+}
+
+// WithBlockOrdering sets the order of the blocks within merged files.
+func WithBlockOrdering(ordering BlockOrdering) Option {
+	return func(m *Merger) {
+		m.ordering = ordering
+	}
+}
+
+// WithFilenameLayouts sets the padding scheme of block numbers in
+// one-block and merged filenames. Files named with older layouts are
+// still read.
+func WithFilenameLayouts(oneBlock, merged FilenameLayout) Option {
+	return func(m *Merger) {
+		m.oneBlockLayout = oneBlock
+		m.mergedLayout = merged
+	}
+}
+
+// WithQuarantine makes the merger move one-block files that cannot be
+// decoded or validated to `store`, along with an `.error`
+// annotation written to `annotationsStore`, instead of failing. The
+// file is excluded from its bundle, which is merged only if it is still
+// complete without it.
+func WithQuarantine(store, annotationsStore dstore.Store) Option {
+	return func(m *Merger) {
+		m.quarantineStore = store
+		m.quarantineAnnotationsStore = annotationsStore
+	}
+}
+
+// WithRetryPolicy sets how listing, downloads, uploads and deletions
+// are retried on the stores.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(m *Merger) {
+		m.retryPolicy = policy
+	}
+}
+
+// WithDownloadConcurrency sets how many one-block files are downloaded
+// at the same time.
+func WithDownloadConcurrency(concurrency int) Option {
+	return func(m *Merger) {
+		m.downloads = newDownloadScheduler(concurrency)
+	}
+}
+
+// WithDownloadCache keeps a copy of downloaded one-block files in `dir`,
+// up to `maxSize` bytes, so they are not downloaded again after a
+// restart. The cache is disabled if the directory cannot be used.
+func WithDownloadCache(dir string, maxSize int64) Option {
+	return func(m *Merger) {
+		cache, err := newDownloadCache(dir, maxSize)
+		if err != nil {
+			zlog.Warn("cannot use download cache, disabling it", zap.String("dir", dir), zap.Error(err))
+			return
+		}
+		m.cache = cache
+	}
+}
+
+// WithJanitor configures the deletion of one-block files: pending
+// deletions are persisted to `pendingDeletionsFile` when not empty, at
+// most `concurrency` files are deleted at the same time, and when old
+// files are deleted, the whole source store is walked every
+// `sweepInterval` to find leftovers.
+func WithJanitor(pendingDeletionsFile string, concurrency int, sweepInterval time.Duration) Option {
+	return func(m *Merger) {
+		m.pendingDeletionsFile = pendingDeletionsFile
+		if concurrency > 0 {
+			m.deleteConcurrency = concurrency
+		}
+		if sweepInterval > 0 {
+			m.sweepInterval = sweepInterval
+		}
+	}
+}
+
+// WithRetention sets what happens to one-block files once merged, or
+// found too old, instead of deleting them right away.
+func WithRetention(retention RetentionPolicy) Option {
+	return func(m *Merger) {
+		m.retention = retention
+	}
+}
+
+// WithMergeJournal records the progress of each merge in `filename`, so
+// a merger restarting after a crash resumes the interrupted merge.
+func WithMergeJournal(filename string) Option {
+	return func(m *Merger) {
+		m.journal = newMergeJournal(filename)
+	}
+}
+
+// WithStateStore keeps the seen blocks cache and the progress in `store`
+// instead of local files, so the merger can run on stateless nodes.
+func WithStateStore(store dstore.Store) Option {
+	return func(m *Merger) {
+		m.seenBlocks = NewSeenBlockCacheInStore(store, m.seenBlocks.keepSize)
+		m.progress = newStoreStateFile(store, ProgressStateObject)
+	}
+}
+
+// WithManifestStore writes a `BundleManifest` for each merged file to
+// `store`.
+func WithManifestStore(store dstore.Store) Option {
+	return func(m *Merger) {
+		m.manifestStore = store
+	}
+}
+
+// WithForkAlertDepth sets the depth from which a fork seen in a bundle
+// is logged as an alert, 0 disables the alert.
+func WithForkAlertDepth(depth int) Option {
+	return func(m *Merger) {
+		m.forkAlertDepth = depth
+	}
+}
+
+// WithStallDetection reports the hole blocking a bundle for longer than
+// `timeout`, with the missing blocks and the files around it, and posts
+// the report to `webhookURL` when set. A zero timeout disables it.
+func WithStallDetection(timeout time.Duration, webhookURL string) Option {
+	return func(m *Merger) {
+		m.stallTimeout = timeout
+		m.stallWebhookURL = webhookURL
+	}
+}
+
+// WithHealthThresholds makes the merger report itself unhealthy when,
+// in live mode, the head block drifts by more than `maxHeadDrift`, or
+// when no new one-block files were listed for `maxTimeWithoutNewFiles`.
+// A zero duration disables the corresponding check.
+func WithHealthThresholds(maxHeadDrift, maxTimeWithoutNewFiles time.Duration) Option {
+	return func(m *Merger) {
+		m.maxHeadDrift = maxHeadDrift
+		m.maxTimeWithoutNewFiles = maxTimeWithoutNewFiles
+	}
+}
+
+// WithUploadRetryBudget sets for how long uploads of merged files are
+// retried before the merger gives up and terminates.
+func WithUploadRetryBudget(budget time.Duration) Option {
+	return func(m *Merger) {
+		m.uploadRetryBudget = budget
+	}
+}
+
+// WithListBatchSize sets the maximum number of good one-block files
+// retrieved by a single listing of the source store.
+func WithListBatchSize(size int) Option {
+	return func(m *Merger) {
+		m.listBatchSize = size
+	}
+}
+
+// WithFilesystemWatch makes the merger rely on inotify events to
+// discover new one-block files when the source store is local, and
+// only walk the whole store every `timeBetweenFullWalks` as a safety
+// net. It has no effect on remote stores.
+func WithFilesystemWatch(timeBetweenFullWalks time.Duration) Option {
+	return func(m *Merger) {
+		m.watchSource = true
+		m.timeBetweenFullWalks = timeBetweenFullWalks
+		if timeBetweenFullWalks <= 0 {
+			m.timeBetweenFullWalks = DefaultTimeBetweenFullWalks
+		}
+	}
 }
 
 func NewMerger(
@@ -65,11 +311,12 @@ func NewMerger(
 	seenCacheFilename string,
 	timeBetweenStoreLookups time.Duration,
 	maxFixableFork uint64,
-	grpcListenAddr string) *Merger {
-	return &Merger{
+	grpcListenAddr string,
+	opts ...Option) *Merger {
+	m := &Merger{
 		Shutter:                 shutter.New(),
 		sourceStore:             sourceStore,
-		progressFilename:        progressFilename,
+		progress:                newLocalStateFile(progressFilename),
 		destStore:               destStore,
 		chunkSize:               100,
 		minimalBlockNum:         minimalBlockNum,
@@ -79,10 +326,45 @@ func NewMerger(
 		grpcListenAddr:          grpcListenAddr,
 		seenBlocks:              NewSeenBlockCache(seenCacheFilename, maxFixableFork),
 		timeBetweenStoreLookups: timeBetweenStoreLookups,
+		listBatchSize:           DefaultListBatchSize,
+		retryPolicy:             DefaultRetryPolicy(),
+		downloads:               newDownloadScheduler(DefaultDownloadConcurrency),
+		uploadRetryBudget:       DefaultUploadRetryBudget,
+		deleteConcurrency:       DefaultJanitorConcurrency,
+		sweepInterval:           DefaultSweepInterval,
+		forkAlertDepth:          DefaultForkAlertDepth,
+		stallTimeout:            DefaultStallTimeout,
+		quarantined:             make(map[string]bool),
+		runID:                   newRunID(),
+		startedAt:               time.Now().UTC(),
+	}
+
+	for _, opt := range opts {
+		opt(m)
 	}
+	m.progress.setRetryPolicy(m.retryPolicy, m.Terminating())
+	m.seenBlocks.file.setRetryPolicy(m.retryPolicy, m.Terminating())
+	m.janitor = newJanitor(sourceStore, m.retryPolicy, m.retention, m.deleteConcurrency, m.pendingDeletionsFile)
+	return m
 }
 
 func (m *Merger) PreMergedBlocks(ctx context.Context, req *pbmerge.Request) (*pbmerge.Response, error) {
+	t0 := time.Now()
+	resp, err := m.preMergedBlocks(req)
+	metrics.PreMergedBlocksDuration.ObserveSince(t0)
+
+	switch {
+	case err != nil:
+		metrics.PreMergedBlocksRequests.Inc("error")
+	case resp != nil && resp.Found:
+		metrics.PreMergedBlocksRequests.Inc("found")
+	default:
+		metrics.PreMergedBlocksRequests.Inc("not_found")
+	}
+	return resp, err
+}
+
+func (m *Merger) preMergedBlocks(req *pbmerge.Request) (*pbmerge.Response, error) {
 	m.bundleLock.Lock()
 	defer m.bundleLock.Unlock()
 
@@ -94,7 +376,7 @@ func (m *Merger) PreMergedBlocks(ctx context.Context, req *pbmerge.Request) (*pb
 		return nil, err
 	}
 
-	files := m.bundle.timeSortedFiles()
+	files := m.bundle.sortedFiles()
 	var foundHighBlockID bool
 	var foundLowBlockNum bool
 	for _, oneBlock := range files {
@@ -111,10 +393,13 @@ func (m *Merger) PreMergedBlocks(ctx context.Context, req *pbmerge.Request) (*pb
 	}
 
 	protoblocks := []*pbbstream.Block{}
-	for _, oneBlock := range m.bundle.timeSortedFiles() {
+	for _, oneBlock := range m.bundle.sortedFiles() {
 		if uint64(oneBlock.num) < req.LowBlockNum {
 			continue
 		}
+		if oneBlock.err != nil {
+			return &pbmerge.Response{}, nil // found=false, will be quarantined
+		}
 		blockReader, err := bstream.GetBlockReaderFactory.New(bytes.NewReader(oneBlock.blk))
 		if err != nil {
 			return nil, fmt.Errorf("unable to read one block: %s", err)
@@ -144,41 +429,105 @@ func (m *Merger) PreMergedBlocks(ctx context.Context, req *pbmerge.Request) (*pb
 }
 
 func (m *Merger) SetupBundle(start, stop uint64) {
-	zlog.Info("Setting up bundle", zap.Uint64("start", start), zap.Uint64("stop", stop), zap.Uint64("chunk_size", m.chunkSize))
+	zlog.Info("Setting up bundle", zap.Uint64("start", start), zap.Uint64("stop", stop), zap.Uint64("chunk_size", m.chunkSize), zap.String("run_id", m.runID))
 	m.liveMode = stop == 0
-	m.bundle = NewBundle(start-(start%m.chunkSize), m.chunkSize)
 	m.stopBlockNum = stop
+	m.rangeStart = start
+	if start < m.firstStreamableBlock {
+		start = m.firstStreamableBlock
+	}
+	m.bundle = NewBundle(start-(start%m.chunkSize), m.chunkSize)
 
 	if m.CacheInvalid() {
 		m.seenBlocks.Reset()
 	}
+	m.configureBundle(m.bundle)
+	if m.sparse && len(m.bundle.mergedTailIDs) == 0 && m.bundle.lowerBlock > 0 {
+		m.seedMergedTail(m.bundle)
+	}
+
+	if m.bundle.lowerBlock > 0 {
+		m.janitor.setHead(m.bundle.lowerBlock - 1) // everything below was merged by a previous run
+	}
 }
 
-func (m *Merger) CacheInvalid() bool {
-	return m.bundle.lowerBlock > m.seenBlocks.HighestSeen+1
+// newBundle creates the bundle starting at `lowerBlock`, configured
+// according to the merger's chain settings.
+func (m *Merger) newBundle(lowerBlock uint64) *Bundle {
+	b := NewBundle(lowerBlock, m.chunkSize)
+	m.configureBundle(b)
+	return b
 }
 
-func deleteOneblockFiles(ctx context.Context, files []string, s dstore.Store) {
-	if len(files) == 0 {
-		return
+func (m *Merger) configureBundle(b *Bundle) {
+	b.firstStreamableBlock = m.firstStreamableBlock
+	b.firstStreamableBlockSet = m.firstStreamableBlockSet
+	b.genesisPreviousID = m.genesisPreviousID
+	b.ordering = m.ordering
+	b.keepFailedDownloads = m.quarantineStore != nil
+	b.retryPolicy = m.retryPolicy
+	b.downloads = m.downloads
+	b.cache = m.cache
+	b.terminating = eitherDone(m.Terminating(), b.abandoned)
+	if m.sparse {
+		b.sparse = true
+		b.mergedTailIDs = m.seenBlocks.IDsBelow(b.lowerBlock)
 	}
-	zlog.Info("Deleting old block files", zap.String("first_file", files[0]), zap.String("last_file", files[len(files)-1]))
-	for i, filename := range files {
-		if i%10 == 0 {
-			zlog.Info("deleting one block files that is older than our seenBlocksBuffer", zap.Int("i", i), zap.Int("len_todelete", len(files)), zap.String("filename", filename))
+}
+
+// seedMergedTail finds the last merged blocks when the seen blocks cache
+// knows none below the bundle, like on a cold start, so that a bundle
+// whose lower slots were skipped can still link to them. The progress
+// checkpoint is used when it ends right below the bundle, the merged
+// files of the destination store otherwise.
+func (m *Merger) seedMergedTail(b *Bundle) {
+	if m.progress != nil {
+		progress, err := m.ReadProgress()
+		if err == nil && progress.NextBlock == b.lowerBlock && progress.TailBlockID != "" {
+			zlog.Info("seeding merged tail from progress", zap.Uint64("bundle_lower_block", b.lowerBlock), zap.String("tail_block_id", progress.TailBlockID))
+			b.mergedTailIDs[progress.TailBlockID] = true
+			return
 		}
-		f := filename //thread safety
-		go s.DeleteObject(ctx, f)
 	}
 
+	ids, err := m.lastMergedBlockIDs(b.lowerBlock)
+	if err != nil {
+		zlog.Warn("cannot read last merged blocks, the bundle may not complete if its lower slots were skipped", zap.Uint64("bundle_lower_block", b.lowerBlock), zap.Error(err))
+		return
+	}
+	zlog.Info("seeding merged tail from destination store", zap.Uint64("bundle_lower_block", b.lowerBlock), zap.Int("block_count", len(ids)))
+	b.mergedTailBlockIDs = ids
+}
+
+func (m *Merger) CacheInvalid() bool {
+	return m.bundle.lowerBlock > m.seenBlocks.HighestSeen+1
 }
 
 func (m *Merger) Launch() {
 	// figure out where to start merging based on dest store
 	zlog.Info("starting merger", zap.Uint64("lower_block_num", m.bundle.lowerBlock))
 
+	if err := m.recoverFromJournal(); err != nil {
+		m.Shutdown(fmt.Errorf("recovering from merge journal: %w", err))
+		return
+	}
+
 	m.startServer()
 
+	if m.watchSource {
+		watcher, err := newSourceWatcher(m.sourceStore)
+		if err != nil {
+			zlog.Warn("cannot watch source store, falling back to polling", zap.Error(err))
+		} else {
+			zlog.Info("watching one-block files directory", zap.String("dir", watcher.dir), zap.Duration("time_between_full_walks", m.timeBetweenFullWalks))
+			m.watcher = watcher
+			go watcher.run()
+			defer watcher.Close()
+		}
+	}
+
+	go m.janitor.run(m.Terminating())
+
 	err := m.launch()
 	zlog.Info("merger exited", zap.Error(err))
 
@@ -201,10 +550,12 @@ func (m *Merger) launch() (err error) {
 					zap.Uint64("new_lowerblock", baseBlockNum),
 				)
 				m.bundleLock.Lock()
+				m.bundle.abandon()
 				m.bundle = NewBundle(baseBlockNum, m.chunkSize)
 				if m.CacheInvalid() {
 					m.seenBlocks.Reset()
 				}
+				m.configureBundle(m.bundle)
 				m.bundleLock.Unlock()
 			}
 
@@ -212,21 +563,31 @@ func (m *Merger) launch() (err error) {
 			defer cancel()
 
 			zlog.Debug("One block file list empty, building list")
-			var tooOldFiles []string
-			tooOldFiles, _, oneBlockFiles, err = m.retrieveListOfFiles(ctx)
+			var tooOldFiles, seenFiles []string
+			tooOldFiles, seenFiles, oneBlockFiles, err = m.nextListOfFiles(ctx)
 			if err != nil {
 				return err
 			}
 
+			m.setListed(oneBlockFiles)
+			m.reportHealth()
+
+			m.janitor.enqueue(seenFiles...) // already merged, their deletion failed
 			if m.deleteBlocksBefore {
-				deleteOneblockFiles(ctx, tooOldFiles, m.sourceStore)
+				m.janitor.enqueue(tooOldFiles...)
 			}
 		}
 
 		if len(oneBlockFiles) == 0 {
+			var watcherNotify <-chan struct{}
+			if m.watcher != nil {
+				watcherNotify = m.watcher.Notify()
+			}
 			select {
 			case <-time.After(m.timeBetweenStoreLookups):
 				continue
+			case <-watcherNotify:
+				continue
 			case <-m.Terminating():
 				return m.Err()
 			}
@@ -236,85 +597,214 @@ func (m *Merger) launch() (err error) {
 		zlog.Debug("Last file", zap.String("file_name", lastFile))
 		blockNum, blockTime, _, _, err := parseFilename(lastFile)
 		if err == nil && blockNum < m.bundle.upperBlock() { // will still drift if there is a hole and lastFile is advancing
-			metrics.HeadBlockTimeDrift.SetBlockTime(blockTime)
+			m.setHeadBlockTime(blockTime)
 		}
 
 		m.bundleLock.Lock()
 		remaining, err := m.triageNewOneBlockFiles(oneBlockFiles)
+		metrics.BundleFiles.SetUint64(uint64(len(m.bundle.fileList)))
+		m.bundleLock.Unlock()
 		if err != nil {
 			return err
 		}
 		oneBlockFiles = remaining
-		m.bundleLock.Unlock()
 
-		incompleteBundle := !m.waitedEnoughForUpperBound() || !m.bundle.isComplete()
+		waitedEnough := m.waitedEnoughForUpperBound()
+		incompleteBundle := !waitedEnough || !m.bundle.isComplete()
+		m.setHoleInBundle(waitedEnough && incompleteBundle, m.bundle.lowerBlock)
+		m.detectStall(waitedEnough && incompleteBundle)
+		m.reportHealth()
 		if incompleteBundle {
 			zlog.Info("waiting for more files to complete bundle", zap.Uint64("bundle_lowerblock", m.bundle.lowerBlock), zap.Int("bundle_length", len(m.bundle.fileList)), zap.String("bundle_upper_block_id", m.bundle.upperBlockID))
+			if m.watcher != nil {
+				// the watcher reports files once, they are kept until they fit in a bundle
+				m.watchedFiles = oneBlockFiles
+			}
 			oneBlockFiles = nil
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
+		if m.quarantineStore != nil {
+			m.bundleLock.Lock()
+			quarantined, err := m.quarantineInvalidFiles()
+			m.bundleLock.Unlock()
+			if err != nil {
+				return err
+			}
+			if quarantined > 0 {
+				zlog.Warn("quarantined one-block files, checking bundle completeness again", zap.Uint64("bundle_lowerblock", m.bundle.lowerBlock), zap.Int("quarantined_count", quarantined))
+				continue
+			}
+		}
+
 		zlog.Info("merging bundle",
 			zap.Uint64("lower_block", m.bundle.lowerBlock),
 			zap.Time("upper_block_time", m.bundle.upperBlockTime),
 			zap.Duration("real_time_drift", time.Since(m.bundle.upperBlockTime)),
 		)
-		m.bundleLock.Lock() // we call mergeUpload AND change the bundle, both need locking VS PreMergedBlocks
+		// This goroutine is the only one modifying the bundle, so merging
+		// it does not need the lock, which would block PreMergedBlocks
+		// for as long as uploads are retried.
 		if err = m.mergeUploadAndDelete(); err != nil {
 			return err
 		}
-		if err := m.seenBlocks.Save(); err != nil {
-			zlog.Error("cannot save SeenBlockCache", zap.String("filename", m.seenBlocks.filename), zap.Error(err))
-		}
 		m.seenBlocks.Truncate()
+		m.forgetQuarantined()
 
 		if m.stopBlockNum > 0 && m.bundle.upperBlock() >= m.stopBlockNum {
 			zlog.Info("reached stop block, terminating process", zap.Uint64("stop_block", m.stopBlockNum))
 			return nil
 		}
 
-		m.bundle = NewBundle(m.bundle.lowerBlock+m.chunkSize, m.chunkSize)
+		m.bundleLock.Lock()
+		m.bundle.abandon() // merged, releases its downloads
+		m.bundle = m.newBundle(m.bundle.lowerBlock + m.chunkSize)
 		m.bundleLock.Unlock()
 	}
 }
-func (m *Merger) retrieveListOfFiles(ctx context.Context) (tooOld []string, seenInCache []string, good []string, err error) {
-	var count int
 
-	err = m.sourceStore.Walk(ctx, "", ".tmp", func(filename string) error {
-		num, _, _, _, err := parseFilename(filename)
-		if err != nil {
-			return nil
+// nextListOfFiles walks the source store, unless a filesystem watcher
+// is active and the last full walk is recent enough, in which case
+// only the files reported by the watcher since the last call are
+// considered.
+func (m *Merger) nextListOfFiles(ctx context.Context) (tooOld []string, seenInCache []string, good []string, err error) {
+	if m.watcher == nil || time.Since(m.lastFullWalk) >= m.timeBetweenFullWalks {
+		if m.watcher != nil {
+			// anything received before the walk starts will be listed by the walk itself
+			m.watcher.drain()
 		}
-		switch {
-		case m.seenBlocks.lowBoundary() == 0 && num < m.bundle.lowerBlock: // edge case: no "seenblock cache"
-			tooOld = append(tooOld, filename)
-		case m.seenBlocks.IsTooOld(num):
+
+		m.watchedFiles = nil // listed again by the walk
+
+		tooOld, seenInCache, good, err = m.retrieveListOfFiles(ctx)
+		if err == nil && m.listResumeAfter == "" {
+			m.lastFullWalk = time.Now() // a walk cut short is resumed by the next lookup
+		}
+		return
+	}
+
+	filenames := append(m.watchedFiles, m.watcher.drain()...)
+	m.watchedFiles = nil
+	sort.Strings(filenames)
+
+	for i, filename := range filenames {
+		if i > 0 && filename == filenames[i-1] {
+			continue
+		}
+		switch m.classifyFile(filename) {
+		case fileTooOld:
 			tooOld = append(tooOld, filename)
-		case m.seenBlocks.SeenBefore(filename):
+		case fileSeen:
 			seenInCache = append(seenInCache, filename)
-		default:
+		case fileGood:
 			good = append(good, filename)
 		}
-		if count%100 == 0 {
-			//zlog.Debug("walking over file",
-			//	zap.String("filename", filename),
-			//	zap.Int("len_too_old", len(tooOld)),
-			//	zap.Int("len_seen_in_cache", len(seenInCache)),
-			//	zap.Int("len_good", len(good)),
-			//)
+	}
+
+	if len(good) > 0 {
+		zlog.Debug("received files from watcher", zap.Int("too_old_files_count", len(tooOld)), zap.Int("good_files_count", len(good)))
+	}
+	return
+}
+
+// retrieveListOfFiles walks the source store, starting at the prefix
+// covering the current bundle and the seen blocks cache low boundary,
+// and stops after `listBatchSize` good files. When a listing was cut
+// short, the next one resumes after the last listed filename.
+func (m *Merger) retrieveListOfFiles(ctx context.Context) (tooOld []string, seenInCache []string, good []string, err error) {
+	start := m.bundle.lowerBlock
+	if low := m.seenBlocks.lowBoundary(); low != 0 && low < start {
+		start = low
+	}
+
+	resumeAfter, resumeLayout := m.listResumeAfter, m.listResumeLayout
+	m.listResumeAfter = ""
+	sweeping := m.deleteBlocksBefore && time.Since(m.lastSweep) >= m.sweepInterval
+
+	var listed int
+	for _, layout := range m.oneBlockLayout.readableLayouts() {
+		if resumeAfter != "" && layout < resumeLayout {
+			continue // listing was cut short in a more recent layout
+		}
+
+		prefix := layout.listingPrefix(start, m.bundle.upperBlock())
+		if m.sparse && m.bundle.upperBlockID == "" {
+			prefix = "" // the first existing block closing the bundle can be far past upperBlock()
+		}
+		if sweeping {
+			prefix = "" // catch leftovers from previous runs, they would never be listed otherwise
 		}
-		count++
 
-		if len(good) >= 2000 {
-			return dstore.StopIteration
+		layoutResumeAfter := ""
+		if layout == resumeLayout && strings.HasPrefix(resumeAfter, prefix) {
+			layoutResumeAfter = resumeAfter
 		}
-		return nil
-	})
 
+		// a failed walk is retried from the start of this layout, so
+		// files are only kept once the walk completes
+		var layoutTooOld, layoutSeen, layoutGood []string
+		var layoutListed int
+		err = m.retryPolicy.Do("list", m.Terminating(), func() error {
+			layoutTooOld, layoutSeen, layoutGood, layoutListed = nil, nil, nil, 0
+			m.listResumeAfter = ""
+
+			return m.sourceStore.Walk(ctx, prefix, ".tmp", func(filename string) error {
+				if m.listResumeAfter != "" {
+					return dstore.StopIteration // local stores keep walking after a StopIteration
+				}
+				if strings.IndexByte(filename, '-') != layout.digits() {
+					return nil // belongs to another layout
+				}
+				if layoutResumeAfter != "" && filename <= layoutResumeAfter {
+					return nil
+				}
+				layoutListed++
+
+				switch m.classifyFile(filename) {
+				case fileTooOld:
+					layoutTooOld = append(layoutTooOld, filename)
+				case fileSeen:
+					layoutSeen = append(layoutSeen, filename)
+				case fileGood:
+					layoutGood = append(layoutGood, filename)
+				}
+
+				if len(good)+len(layoutGood) >= m.listBatchSize {
+					m.listResumeAfter = filename
+					m.listResumeLayout = layout
+					return dstore.StopIteration
+				}
+				return nil
+			})
+		})
+		tooOld = append(tooOld, layoutTooOld...)
+		seenInCache = append(seenInCache, layoutSeen...)
+		good = append(good, layoutGood...)
+		listed += layoutListed
+		if err != nil || m.listResumeAfter != "" {
+			break
+		}
+	}
+	if sweeping {
+		// a sweep is done once the listings resumed one after the
+		// other from the beginning of the store reach its end
+		fromStart := err == nil && (resumeAfter == "" || m.sweepResuming)
+		m.sweepResuming = fromStart && m.listResumeAfter != ""
+		if fromStart && m.listResumeAfter == "" {
+			m.lastSweep = time.Now()
+		}
+	}
+
+	metrics.ListedFilesPerPoll.SetUint64(uint64(listed))
+	metrics.ListedFilesPerCategory.SetUint64(uint64(len(tooOld)), "too_old")
+	metrics.ListedFilesPerCategory.SetUint64(uint64(len(seenInCache)), "seen")
+	metrics.ListedFilesPerCategory.SetUint64(uint64(len(good)), "good")
 	zlog.Info("retrieved list of files",
+		zap.String("resumed_after", resumeAfter),
 		zap.Uint64("seenblock_low_boundary", m.seenBlocks.lowBoundary()),
 		zap.Uint64("bundle_lower_block", m.bundle.lowerBlock),
+		zap.Int("listed_files_count", listed),
 		zap.Int("seen_files_count", len(seenInCache)),
 		zap.Int("too_old_files_count", len(tooOld)),
 		zap.Int("good_files_count", len(good)),
@@ -323,6 +813,34 @@ func (m *Merger) retrieveListOfFiles(ctx context.Context) (tooOld []string, seen
 	return
 }
 
+type fileClass int
+
+const (
+	fileInvalid fileClass = iota
+	fileTooOld
+	fileSeen
+	fileGood
+)
+
+func (m *Merger) classifyFile(filename string) fileClass {
+	num, _, _, _, err := parseFilename(filename)
+	if err != nil {
+		return fileInvalid
+	}
+
+	switch {
+	case m.seenBlocks.lowBoundary() == 0 && num < m.bundle.lowerBlock: // edge case: no "seenblock cache"
+		return fileTooOld
+	case m.seenBlocks.IsTooOld(num):
+		return fileTooOld
+	case m.seenBlocks.SeenBefore(filename):
+		return fileSeen
+	case m.quarantined[filename]:
+		return fileSeen // handled, its deletion is pending
+	}
+	return fileGood
+}
+
 func (m *Merger) triageNewOneBlockFiles(in []string) (remaining []string, err error) {
 	if len(in) > 0 {
 		zlog.Debug("entering triage", zap.String("first_file", in[0]), zap.String("last_file", in[len(in)-1]))
@@ -348,8 +866,14 @@ func (m *Merger) triageNewOneBlockFiles(in []string) (remaining []string, err er
 // processes that would have been in the process of writing a
 // one-block file, had the time to finish writing, and didn't move the
 // lower boundary of our bundle.
+//
+// When the LIB found in filenames past the bundle covers the whole
+// bundle, there is no need to wait.
 func (m *Merger) waitedEnoughForUpperBound() bool {
-	return !m.bundle.upperBlockTime.IsZero() && time.Since(m.bundle.upperBlockTime) > m.writersLeewayDuration
+	if m.bundle.upperBlockTime.IsZero() {
+		return false
+	}
+	return m.bundle.upperBoundIrreversible() || time.Since(m.bundle.upperBlockTime) > m.writersLeewayDuration
 }
 
 func (m *Merger) mergeUploadAndDelete() error {
@@ -367,7 +891,11 @@ func (m *Merger) mergeUploadAndDelete() error {
 		return fmt.Errorf("unable to create writer: %s", err)
 	}
 
-	for _, oneBlock := range b.timeSortedFiles() {
+	for _, oneBlock := range b.sortedFiles() {
+		if oneBlock.err != nil {
+			return fmt.Errorf("one block file %q is invalid: %w", oneBlock.name, oneBlock.err)
+		}
+
 		blockReader, err := bstream.GetBlockReaderFactory.New(bytes.NewReader(oneBlock.blk))
 		if err != nil {
 			return fmt.Errorf("unable to read one block: %s", err)
@@ -384,55 +912,79 @@ func (m *Merger) mergeUploadAndDelete() error {
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), WriteObjectTimeout)
-	defer cancel()
+	tail := b.tailFile()
+	forks := b.forkStats()
+	m.reportForks(b, forks)
+
+	allFilenames := b.filenames()
+	m.journal.record(b.lowerBlock, phaseDownloaded, allFilenames)
 
-	err = m.destStore.WriteObject(ctx, blockNumToStr(b.lowerBlock), bytes.NewReader(buffer.Bytes()))
+	err = m.uploadMergedFile(m.mergedLayout.blockNumToStr(b.lowerBlock), buffer.Bytes())
 	if err != nil {
 		return fmt.Errorf("write object error: %s", err)
 	}
+	m.journal.record(b.lowerBlock, phaseUploaded, allFilenames)
 
-	metrics.HeadBlockTimeDrift.SetBlockTime(b.upperBlockTime)
+	m.setHeadBlockTime(b.upperBlockTime)
 	metrics.HeadBlockNumber.SetUint64(b.lowerBlock + m.chunkSize)
 
-	if m.progressFilename != "" {
-		err := ioutil.WriteFile(m.progressFilename, []byte(fmt.Sprintf("%d", b.lowerBlock+m.chunkSize)), 0644)
-		if err != nil {
-			zlog.Warn("cannot write progress to file", zap.String("filename", m.progressFilename), zap.Error(err))
-		}
+	if err := m.writeProgress(b, tail); err != nil {
+		zlog.Warn("cannot write progress to file", zap.Stringer("filename", m.progress), zap.Error(err))
+	}
+
+	if err := m.writeManifest(b, tail, forks); err != nil {
+		zlog.Warn("cannot write bundle manifest", zap.Uint64("lower_block", b.lowerBlock), zap.Error(err))
 	}
 
-	zlog.Info("merged and uploaded", zap.String("filename", blockNumToStr(b.lowerBlock)), zap.Duration("merge_time", time.Since(t0)))
+	metrics.MergeDuration.ObserveSince(t0)
+	zlog.Info("merged and uploaded", append(forks.fields(), zap.String("filename", m.mergedLayout.blockNumToStr(b.lowerBlock)), zap.Duration("merge_time", time.Since(t0)))...)
 
-	for filename := range b.fileList {
+	for _, filename := range allFilenames {
 		m.seenBlocks.Add(filename) // add them to 'seenbefore' right before deleting them on gs
-	}
-	zlog.Debug("deleting oneblock files")
-	eg := llerrgroup.New(64)
-	for filename := range b.fileList {
-		if eg.Stop() {
-			break
+		if m.cache != nil {
+			m.cache.remove(filename) // merged, never needed again
 		}
+	}
+	if err := m.seenBlocks.Save(); err != nil {
+		zlog.Error("cannot save SeenBlockCache", zap.Stringer("filename", m.seenBlocks.file), zap.Error(err))
+	}
+	m.journal.record(b.lowerBlock, phaseSeenCacheUpdated, allFilenames)
 
-		f := filename
-		eg.Go(func() error {
-			ctx, cancel := context.WithTimeout(context.Background(), DeleteObjectTimeout)
-			defer cancel()
+	m.janitor.setHead(b.upperBlock() - 1)
+	m.janitor.enqueue(allFilenames...)
+	m.journal.record(b.lowerBlock, phaseDeleted, allFilenames)
 
-			err = m.sourceStore.DeleteObject(ctx, f)
-			if err != nil && err.Error() != storage.ErrObjectNotExist.Error() {
-				zlog.Error("cannot delete onefile object after merging", zap.String("filename", f), zap.Error(err))
-			}
-			return nil
-		})
-	}
-	err = eg.Wait()
+	return nil
+}
+
+// uploadMergedFile writes the merged file to the destination store,
+// retrying until it succeeds, the merger terminates, or
+// `uploadRetryBudget` is spent. The merger reports itself as unhealthy
+// while retrying.
+func (m *Merger) uploadMergedFile(filename string, content []byte) error {
+	policy := m.retryPolicy
+	policy.Attempts = 0
+	policy.Budget = m.uploadRetryBudget
+	policy.MaxBackoff = UploadRetryMaxBackoff
+	defer m.setUploadRetrying(false)
+
+	t0 := time.Now()
+	err := policy.Do("upload", m.Terminating(), func() error {
+		ctx, cancel := m.terminatingContext(WriteObjectTimeout)
+		defer cancel()
+
+		err := m.destStore.WriteObject(ctx, filename, bytes.NewReader(content))
+		if err != nil {
+			m.setUploadRetrying(true)
+		}
+		return err
+	})
 	if err != nil {
-		zlog.Warn("cannot delete oneblockfile", zap.Error(err))
-	} else {
-		zlog.Debug("done deleting one-block files", zap.Int("len_filelist", len(b.fileList)))
+		return err
 	}
 
+	metrics.UploadedBytes.AddInt(len(content))
+	metrics.UploadDuration.ObserveSince(t0)
 	return nil
 }
 
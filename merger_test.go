@@ -17,10 +17,12 @@ package merger
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -30,6 +32,7 @@ import (
 	"github.com/dfuse-io/dstore"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	pb "github.com/dfuse-io/pbgo/dfuse/merger/v1"
+	pbhealth "github.com/dfuse-io/pbgo/grpc/health/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -64,6 +67,18 @@ func NewTestBlock(id string, num uint64) *bstream.Block {
 	}
 }
 
+// testBlockForFile returns a block matching the fields of a one-block filename
+func testBlockForFile(filename string) *bstream.Block {
+	f, err := parseOneBlockFilename(filename)
+	derr.Check("unable to parse test filename", err)
+
+	block := NewTestBlock(f.id, f.num)
+	block.PreviousId = f.previousID
+	block.Timestamp = f.blockTime
+	block.LibNum = f.libNum
+	return block
+}
+
 func writeOneBlockFile(block *bstream.Block, filename string, store dstore.Store) {
 	buffer := bytes.NewBuffer([]byte{})
 	blockWriter, err := bstream.GetBlockWriterFactory.New(buffer)
@@ -110,29 +125,29 @@ func TestMergeUploadAndDelete(t *testing.T) {
 	defer cleanup()
 
 	writeOneBlockFile(
-		NewTestBlock("dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64", 100),
+		testBlockForFile("0000000100-19700117T153111.4-dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64-db10afd3efa45327eb284c83cc925bd9bd7966aea53067c1eebe0724d124ec1e"),
 		"0000000100-19700117T153111.4-dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64-db10afd3efa45327eb284c83cc925bd9bd7966aea53067c1eebe0724d124ec1e",
 		oneStore,
 	)
 	writeOneBlockFile(
-		NewTestBlock("4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc", 101),
+		testBlockForFile("0000000101-19700117T153112.4-4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc-dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64"),
 		"0000000101-19700117T153112.4-4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc-dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64",
 		oneStore,
 	)
 
 	writeOneBlockFile(
-		NewTestBlock("16110f3aa1895de2ec22cfd746751f724d112a953c71b62858a1523b50f3dc64", 102),
+		testBlockForFile("0000000102-19700117T153113.4-16110f3aa1895de2ec22cfd746751f724d112a953c71b62858a1523b50f3dc64-4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc"),
 		"0000000102-19700117T153113.4-16110f3aa1895de2ec22cfd746751f724d112a953c71b62858a1523b50f3dc64-4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc",
 		oneStore,
 	)
 
 	writeOneBlockFile(
-		NewTestBlock("39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713", 103),
+		testBlockForFile("0000000103-19700117T153114.4-39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713-16110f3aa1895de2ec22cfd746751f724d112a953c71b62858a1523b50f3dc64"),
 		"0000000103-19700117T153114.4-39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713-16110f3aa1895de2ec22cfd746751f724d112a953c71b62858a1523b50f3dc64",
 		oneStore,
 	)
 	writeOneBlockFile(
-		NewTestBlock("7faae5e905007d146c15b22dcb736935cb344f88be0d35fe656701e84d52398e", 104),
+		testBlockForFile("0000000104-19700117T153115.4-7faae5e905007d146c15b22dcb736935cb344f88be0d35fe656701e84d52398e-39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713"),
 		"0000000104-19700117T153115.4-7faae5e905007d146c15b22dcb736935cb344f88be0d35fe656701e84d52398e-39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713",
 		oneStore,
 	)
@@ -145,7 +160,7 @@ func TestMergeUploadAndDelete(t *testing.T) {
 		"0000000104-19700117T153115.4-7faae5e905007d146c15b22dcb736935cb344f88be0d35fe656701e84d52398e-39bef3da2cd14e02781b576050dc426606149bff937a4af43e65417e6e98c713",
 	})
 
-	m.mergeUploadAndDelete()
+	require.NoError(t, m.mergeUploadAndDelete())
 
 	readBack, err := multiStore.OpenObject(context.Background(), "0000000100")
 	require.NoError(t, err)
@@ -276,7 +291,7 @@ func TestPreMergedBlocks(t *testing.T) {
 			var writtenFileNames []string
 			for _, blk := range test.writeBlocks {
 				writeOneBlockFile(
-					NewTestBlock(blk.id, blk.num),
+					testBlockForFile(blk.filename),
 					blk.filename,
 					oneStore,
 				)
@@ -314,3 +329,236 @@ func mustReadBlock(t *testing.T, reader bstream.BlockReader) *bstream.Block {
 
 	return block
 }
+
+func TestRetrieveListOfFilesPagination(t *testing.T) {
+	m, oneStore, _, cleanup := setupMerger(t)
+	defer cleanup()
+
+	m.seenBlocks.Reset()
+	m.listBatchSize = 3
+
+	writeOneBlockFile(testBlockForFile("0000000099-19700117T153110.4-00000099a-00000098a"), "0000000099-19700117T153110.4-00000099a-00000098a", oneStore)
+	for _, blk := range []*testBlockFile{blk100, blk101, blk102, blk103, blk104} {
+		writeOneBlockFile(testBlockForFile(blk.filename), blk.filename, oneStore)
+	}
+	writeOneBlockFile(testBlockForFile("0000001000-19700117T153110.4-00001000a-00000999a"), "0000001000-19700117T153110.4-00001000a-00000999a", oneStore)
+
+	tooOld, _, good, err := m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000000099-19700117T153110.4-00000099a-00000098a"}, tooOld)
+	assert.Equal(t, []string{blk100.filename, blk101.filename, blk102.filename}, good)
+
+	tooOld, _, good, err = m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, tooOld, 0)
+	assert.Equal(t, []string{blk103.filename, blk104.filename}, good, "resumes after last listed file, out of range files are not listed")
+
+	_, _, good, err = m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{blk100.filename, blk101.filename, blk102.filename}, good, "starts over once a listing was complete")
+}
+
+func TestRetrieveListOfFilesSparse(t *testing.T) {
+	m, oneStore, _, cleanup := setupMerger(t)
+	defer cleanup()
+
+	m.seenBlocks.Reset()
+	m.sparse = true
+	m.bundle.sparse = true
+	far := "0000001000-19700117T153120.4-00001000a-" + blk101.id
+	for _, filename := range []string{blk100.filename, blk101.filename, far} {
+		writeOneBlockFile(testBlockForFile(filename), filename, oneStore)
+	}
+
+	_, _, good, err := m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{blk100.filename, blk101.filename, far}, good, "lists past the prefix of the bundle while its upper bound is unknown")
+
+	m.triageNewOneBlockFiles(good)
+	assert.Equal(t, uint64(1000), m.bundle.upperBlockNum)
+	assert.True(t, m.bundle.isComplete())
+}
+
+func TestRetrieveListOfFilesSweep(t *testing.T) {
+	m, oneStore, _, cleanup := setupMerger(t)
+	defer cleanup()
+
+	m.seenBlocks.Reset()
+	m.listBatchSize = 2
+	m.deleteBlocksBefore = true
+	for _, blk := range []*testBlockFile{blk100, blk101, blk102} {
+		writeOneBlockFile(testBlockForFile(blk.filename), blk.filename, oneStore)
+	}
+
+	_, _, good, err := m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{blk100.filename, blk101.filename}, good)
+	assert.True(t, m.lastSweep.IsZero(), "sweep cut short")
+
+	_, _, good, err = m.retrieveListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{blk102.filename}, good)
+	assert.False(t, m.lastSweep.IsZero(), "sweep reached the end of the store")
+}
+
+func TestMergeUploadAndDeleteInvalidBlock(t *testing.T) {
+	m, oneStore, multiStore, cleanup := setupMerger(t)
+	defer cleanup()
+
+	writeOneBlockFile(testBlockForFile(blk100.filename), blk100.filename, oneStore)
+	writeOneBlockFile(testBlockForFile(blk102.filename), blk101.filename, oneStore) // mis-named
+
+	m.triageNewOneBlockFiles([]string{blk100.filename, blk101.filename})
+
+	err := m.mergeUploadAndDelete()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), blk101.filename)
+
+	exists, err := multiStore.FileExists(context.Background(), "0000000100")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestValidateOneBlock(t *testing.T) {
+	encode := func(block *bstream.Block) []byte {
+		buffer := bytes.NewBuffer([]byte{})
+		blockWriter, err := bstream.GetBlockWriterFactory.New(buffer)
+		require.NoError(t, err)
+		require.NoError(t, blockWriter.Write(block))
+		return buffer.Bytes()
+	}
+
+	filename := "0000000101-20170701T122141.5-dbda3f44-09f6d693-99-mindreader"
+	valid := func() *bstream.Block {
+		block := NewTestBlock("00000065aaaaaaaadbda3f44", 101)
+		block.PreviousId = "00000064bbbbbbbb09f6d693"
+		block.Timestamp = time.Date(2017, 7, 1, 12, 21, 41, 500000000, time.UTC)
+		block.LibNum = 99
+		return block
+	}
+
+	tests := []struct {
+		name        string
+		alter       func(b *bstream.Block)
+		expectError bool
+	}{
+		{name: "valid", alter: func(b *bstream.Block) {}},
+		{name: "truncated timestamp", alter: func(b *bstream.Block) { b.Timestamp = b.Timestamp.Add(50 * time.Millisecond) }},
+		{name: "wrong number", alter: func(b *bstream.Block) { b.Number = 102 }, expectError: true},
+		{name: "wrong id", alter: func(b *bstream.Block) { b.Id = "00000065aaaaaaaadbda3f45" }, expectError: true},
+		{name: "wrong previous id", alter: func(b *bstream.Block) { b.PreviousId = "00000064bbbbbbbb09f6d694" }, expectError: true},
+		{name: "wrong lib", alter: func(b *bstream.Block) { b.LibNum = 98 }, expectError: true},
+		{name: "wrong timestamp", alter: func(b *bstream.Block) { b.Timestamp = b.Timestamp.Add(2 * time.Second) }, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bf, err := parseOneBlockFilename(filename)
+			require.NoError(t, err)
+
+			block := valid()
+			test.alter(block)
+			bf.blk = encode(block)
+
+			err = validateOneBlock(bf)
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	bf, err := parseOneBlockFilename(filename)
+	require.NoError(t, err)
+	bf.blk = []byte("garbage")
+	assert.Error(t, validateOneBlock(bf))
+}
+
+func TestUploadMergedFileRetries(t *testing.T) {
+	failures := 2
+	var written []string
+	dst := dstore.NewMockStore(func(base string, f io.Reader) error {
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("transient failure")
+		}
+		written = append(written, base)
+		return nil
+	})
+
+	m := NewMerger(dstore.NewMockStore(nil), dst, 0, 0, "", false, "/tmp/testmergergob", 0, 999999, "", WithRetryPolicy(RetryPolicy{BaseBackoff: time.Millisecond}))
+	require.NoError(t, m.uploadMergedFile("0000000100", []byte("content")))
+	assert.Equal(t, []string{"0000000100"}, written)
+
+	m.setListed(nil)
+	resp, err := m.Check(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, pbhealth.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestUploadMergedFileGivesUp(t *testing.T) {
+	dst := dstore.NewMockStore(func(base string, f io.Reader) error {
+		return fmt.Errorf("permanent failure")
+	})
+
+	m := NewMerger(dstore.NewMockStore(nil), dst, 0, 0, "", false, "/tmp/testmergergob", 0, 999999, "", WithRetryPolicy(RetryPolicy{BaseBackoff: time.Millisecond}), WithUploadRetryBudget(20*time.Millisecond))
+	err := m.uploadMergedFile("0000000100", []byte("content"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "permanent failure")
+
+	m.Shutdown(nil)
+	dst = dstore.NewMockStore(func(base string, f io.Reader) error {
+		return fmt.Errorf("failure")
+	})
+	m.destStore = dst
+	m.uploadRetryBudget = time.Hour
+	assert.Error(t, m.uploadMergedFile("0000000100", []byte("content")))
+}
+
+func TestSetupBundleSeedsMergedTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dst, err := dstore.NewDBinStore(dir)
+	require.NoError(t, err)
+
+	// bundle 100 was merged by a previous run, slot 200 was skipped
+	buffer := bytes.NewBuffer(nil)
+	blockWriter, err := bstream.GetBlockWriterFactory.New(buffer)
+	require.NoError(t, err)
+	for _, num := range []uint64{101, 150, 198} {
+		require.NoError(t, blockWriter.Write(NewTestBlock("ffffffff"+numToID(num, "a"), num)))
+	}
+	require.NoError(t, dst.WriteObject(context.Background(), "0000000100", bytes.NewReader(buffer.Bytes())))
+
+	tests := []struct {
+		name     string
+		store    dstore.Store
+		progress string
+		expect   bool
+	}{
+		{name: "from destination store", store: dst, expect: true},
+		{name: "from progress", store: dstore.NewMockStore(nil), progress: `{"version":1,"next_block":200,"tail_block_id":"` + numToID(198, "a") + `"}`, expect: true},
+		{name: "no merged block known", store: dstore.NewMockStore(nil), expect: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			progressFile := ""
+			if test.progress != "" {
+				progressFile = filepath.Join(dir, "progress")
+				require.NoError(t, ioutil.WriteFile(progressFile, []byte(test.progress), 0644))
+			}
+
+			m := NewMerger(dstore.NewMockStore(nil), test.store, 0, 0, progressFile, false, "", 0, 999999, "", WithSparseChain())
+			m.SetupBundle(200, 0)
+
+			b := m.bundle
+			b.fileList = sparseBlocksGetter(198, 201, 250, 299)()
+			b.upperBlockID = numToID(299, "a")
+			assert.Equal(t, test.expect, b.isComplete())
+		})
+	}
+}
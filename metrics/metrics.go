@@ -20,3 +20,41 @@ var MetricSet = dmetrics.NewSet()
 
 var HeadBlockTimeDrift = MetricSet.NewHeadTimeDrift("merger")
 var HeadBlockNumber = MetricSet.NewHeadBlockNumber("merger")
+
+var ListedFilesPerPoll = MetricSet.NewGauge("merger_listed_files_per_poll", "Number of one-block files listed during the last poll of the source store")
+var ListedFilesPerCategory = MetricSet.NewGaugeVec("merger_listed_files_per_category", []string{"category"}, "Number of one-block files listed during the last poll of the source store, by category (too_old, seen or good)")
+var BundleFiles = MetricSet.NewGauge("merger_bundle_files", "Number of one-block files in the bundle being merged")
+
+var MergeDuration = MetricSet.NewHistogram("merger_merge_duration", "Time taken to merge and upload a bundle once complete, in seconds")
+var UploadedBytes = MetricSet.NewCounter("merger_uploaded_bytes", "Number of bytes of merged files uploaded")
+var UploadDuration = MetricSet.NewHistogram("merger_upload_duration", "Time taken to upload a merged file, retries included, in seconds")
+var QuarantinedFiles = MetricSet.NewCounter("merger_quarantined_files", "Number of one-block files moved to the quarantine store")
+var StoreOperationRetries = MetricSet.NewCounterVec("merger_store_operation_retries", []string{"operation"}, "Number of retried operations on the stores, by operation")
+
+var PendingDownloads = MetricSet.NewGauge("merger_pending_downloads", "Number of one-block files waiting for a download slot")
+var DownloadedBytes = MetricSet.NewCounter("merger_downloaded_bytes", "Number of bytes of one-block files downloaded")
+var DownloadDuration = MetricSet.NewHistogram("merger_download_duration", "Time taken to download a one-block file, in seconds")
+
+var DownloadCacheHits = MetricSet.NewCounter("merger_download_cache_hits", "Number of one-block files read from the local download cache")
+var DownloadCacheMisses = MetricSet.NewCounter("merger_download_cache_misses", "Number of one-block files not found in the local download cache")
+var DownloadCacheSize = MetricSet.NewGauge("merger_download_cache_size_bytes", "Size of the one-block files in the local download cache")
+
+var PendingDeletions = MetricSet.NewGauge("merger_pending_deletions", "Number of one-block files waiting to be deleted from the source store")
+var FailedDeletions = MetricSet.NewCounter("merger_failed_deletions", "Number of failed deletions of one-block files, retried later")
+var DeletedFiles = MetricSet.NewCounter("merger_deleted_files", "Number of one-block files deleted from the source store")
+var DeleteDuration = MetricSet.NewHistogram("merger_delete_duration", "Time taken to delete a one-block file, archiving and retries included, in seconds")
+
+var NonCanonicalBlocks = MetricSet.NewCounter("merger_non_canonical_blocks", "Number of forked blocks, not part of the canonical chain, found in merged bundles")
+var ForkBranches = MetricSet.NewCounter("merger_fork_branches", "Number of distinct fork branches found in merged bundles")
+var DeepestFork = MetricSet.NewGauge("merger_deepest_fork", "Number of blocks of the deepest fork branch of the last merged bundle")
+
+var PreMergedBlocksRequests = MetricSet.NewCounterVec("merger_pre_merged_blocks_requests", []string{"result"}, "Number of PreMergedBlocks requests, by result (found, not_found or error)")
+var PreMergedBlocksDuration = MetricSet.NewHistogram("merger_pre_merged_blocks_duration", "Time taken to answer a PreMergedBlocks request, in seconds")
+
+var SeenCacheBlocks = MetricSet.NewGauge("merger_seen_cache_blocks", "Number of block IDs in the seen blocks cache")
+var SeenCacheBytes = MetricSet.NewGauge("merger_seen_cache_bytes", "Approximate memory used by the seen blocks cache")
+
+var Unhealthy = MetricSet.NewGaugeVec("merger_unhealthy", []string{"reason"}, "Set to 1 while the condition named by reason makes the merger unhealthy")
+var BundleStalled = MetricSet.NewGauge("merger_bundle_stalled", "Set to 1 while a hole blocks the current bundle for longer than the stall timeout")
+var StallMissingBlocks = MetricSet.NewGauge("merger_stall_missing_blocks", "Number of block numbers without any one-block file below the hole stalling the current bundle")
+var StallWebhookFailures = MetricSet.NewCounter("merger_stall_webhook_failures", "Number of stall reports that could not be posted to the webhook")
@@ -21,33 +21,118 @@ import (
 	"time"
 )
 
-func blockNumToStr(blockNum uint64) (blockStr string) {
-	return fmt.Sprintf("%010d", blockNum)
+// FilenameLayout is the padding scheme of block numbers in one-block
+// and merged filenames. Filenames of any layout can be read, the layout
+// is used to name merged files and to compute listing prefixes.
+type FilenameLayout int
+
+const (
+	// FilenameLayoutV0 pads block numbers to 10 digits, like
+	// `0000000100`, which only keeps lexical order up to 32-bit numbers.
+	FilenameLayoutV0 FilenameLayout = iota
+	// FilenameLayoutV1 pads block numbers to 20 digits, like
+	// `00000000000000000100`, which fits any 64-bit number.
+	FilenameLayoutV1
+)
+
+func ParseFilenameLayout(in string) (FilenameLayout, error) {
+	switch in {
+	case "", "v0":
+		return FilenameLayoutV0, nil
+	case "v1":
+		return FilenameLayoutV1, nil
+	}
+	return 0, fmt.Errorf("unknown filename layout %q, valid values are \"v0\" and \"v1\"", in)
+}
+
+func (l FilenameLayout) String() string {
+	return fmt.Sprintf("v%d", int(l))
+}
+
+func (l FilenameLayout) digits() int {
+	if l == FilenameLayoutV1 {
+		return 20
+	}
+	return 10
+}
+
+// readableLayouts returns the layouts to look for when this one is in
+// use, older layouts first, to support stores written before a change
+// of layout.
+func (l FilenameLayout) readableLayouts() (out []FilenameLayout) {
+	for layout := FilenameLayoutV0; layout <= l; layout++ {
+		out = append(out, layout)
+	}
+	return
+}
+
+func (l FilenameLayout) blockNumToStr(blockNum uint64) string {
+	return fmt.Sprintf("%0*d", l.digits(), blockNum)
+}
+
+// listingPrefix returns the longest filename prefix shared by all
+// block numbers between `low` and `high` inclusively.
+func (l FilenameLayout) listingPrefix(low, high uint64) string {
+	lowStr := l.blockNumToStr(low)
+	highStr := l.blockNumToStr(high)
+	for i := range lowStr {
+		if lowStr[i] != highStr[i] {
+			return lowStr[:i]
+		}
+	}
+	return lowStr
 }
 
 // parseFilename parses file names formatted like:
 // * 0000000100-20170701T122141.0-24a07267-e5914b39
 // * 0000000101-20170701T122141.5-dbda3f44-09f6d693
+// * 00000000000000000101-20170701T122141.5-dbda3f44-09f6d693
+// * 0000000101-20170701T122141.5-dbda3f44-09f6d693-0000000099-mindreader-1
 func parseFilename(filename string) (blockNum uint64, blockTime time.Time, blockIDSuffix string, previousBlockIDSuffix string, err error) {
-	parts := strings.Split(filename, "-")
-	if len(parts) != 4 {
-		err = fmt.Errorf("wrong filename format: %q", filename)
+	f, err := parseOneBlockFilename(filename)
+	if err != nil {
 		return
 	}
-	blockNumVal, err := strconv.ParseUint(parts[0], 10, 32)
+	return f.num, f.blockTime, f.id, f.previousID, nil
+}
+
+// parseOneBlockFilename parses all the fields of a one-block filename,
+// in one of these schemas:
+// * v0: {BLOCKNUM}-{TIMESTAMP}-{BLOCKID}-{PREVIOUSID}
+// * v1: {BLOCKNUM}-{TIMESTAMP}-{BLOCKID}-{PREVIOUSID}-{LIBNUM}-{PRODUCER}
+//
+// The producer being the last field, it can itself contain dashes.
+func parseOneBlockFilename(filename string) (*OneBlockFile, error) {
+	parts := strings.Split(filename, "-")
+	if len(parts) != 4 && len(parts) < 6 {
+		return nil, fmt.Errorf("wrong filename format: %q", filename)
+	}
+
+	blockNum, err := strconv.ParseUint(parts[0], 10, 64)
 	if err != nil {
-		err = fmt.Errorf("failed parsing %q: %s", parts[0], err)
-		return
+		return nil, fmt.Errorf("failed parsing %q: %s", parts[0], err)
 	}
-	blockNum = uint64(blockNumVal)
 
-	blockTime, err = time.Parse("20060102T150405.999999", parts[1])
+	blockTime, err := time.Parse("20060102T150405.999999", parts[1])
 	if err != nil {
-		err = fmt.Errorf("failed parsing %q: %s", parts[1], err)
-		return
+		return nil, fmt.Errorf("failed parsing %q: %s", parts[1], err)
 	}
 
-	blockIDSuffix = parts[2]
-	previousBlockIDSuffix = parts[3]
-	return
+	f := &OneBlockFile{
+		name:       filename,
+		blockTime:  blockTime,
+		id:         parts[2],
+		num:        blockNum,
+		previousID: parts[3],
+	}
+
+	if len(parts) > 4 {
+		f.libNum, err = strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %q: %s", parts[4], err)
+		}
+		f.producer = strings.Join(parts[5:], "-")
+	}
+
+	return f, nil
 }
@@ -0,0 +1,118 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ProgressVersion is the version of the checkpoint written to the
+// progress file. Older progress files only contain `NextBlock` as text.
+const ProgressVersion = 1
+
+// Progress is the checkpoint written to the progress file after each
+// merged bundle.
+type Progress struct {
+	Version          int       `json:"version"`
+	NextBlock        uint64    `json:"next_block"`         // first block of the next bundle, where a restart begins
+	LastMergedBundle uint64    `json:"last_merged_bundle"` // lower block of the last merged bundle
+	TailBlockNum     uint64    `json:"tail_block_num"`
+	TailBlockID      string    `json:"tail_block_id"`
+	TailBlockTime    time.Time `json:"tail_block_time"`
+	RunID            string    `json:"run_id"`
+	RangeStart       uint64    `json:"range_start"`
+	RangeStop        uint64    `json:"range_stop"` // 0 in live mode
+	StartedAt        time.Time `json:"started_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// ParseProgress decodes the content of a progress file, in the JSON
+// format or as the bare next block number written by older versions.
+func ParseProgress(content []byte) (*Progress, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 || content[0] != '{' {
+		next, err := strconv.ParseUint(string(content), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid progress %q: %w", string(content), err)
+		}
+		return &Progress{NextBlock: next}, nil
+	}
+
+	progress := &Progress{}
+	if err := json.Unmarshal(content, progress); err != nil {
+		return nil, fmt.Errorf("decoding progress: %w", err)
+	}
+	if progress.Version < 1 || progress.Version > ProgressVersion {
+		return nil, fmt.Errorf("unsupported progress version %d", progress.Version)
+	}
+	return progress, nil
+}
+
+// ReadProgress returns the last checkpoint, with an error satisfying
+// `os.IsNotExist` when there is none.
+func (m *Merger) ReadProgress() (*Progress, error) {
+	content, err := m.progress.read()
+	if err != nil {
+		return nil, err
+	}
+	return ParseProgress(content)
+}
+
+// RunID identifies this run of the merger in the progress checkpoints.
+func (m *Merger) RunID() string {
+	return m.runID
+}
+
+func (m *Merger) writeProgress(b *Bundle, tail *OneBlockFile) error {
+	if m.progress == nil {
+		return nil
+	}
+
+	progress := &Progress{
+		Version:          ProgressVersion,
+		NextBlock:        b.lowerBlock + m.chunkSize,
+		LastMergedBundle: b.lowerBlock,
+		RunID:            m.runID,
+		RangeStart:       m.rangeStart,
+		RangeStop:        m.stopBlockNum,
+		StartedAt:        m.startedAt,
+		UpdatedAt:        time.Now().UTC(),
+	}
+	if tail != nil {
+		progress.TailBlockNum = tail.num
+		progress.TailBlockID = tail.id
+		progress.TailBlockTime = tail.blockTime.UTC()
+	}
+
+	content, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return m.progress.write(content)
+}
+
+func newRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectNext  uint64
+		expectError bool
+	}{
+		{name: "legacy", content: "200", expectNext: 200},
+		{name: "legacy with newline", content: "200\n", expectNext: 200},
+		{name: "json", content: `{"version":1,"next_block":300,"last_merged_bundle":200}`, expectNext: 300},
+		{name: "unsupported version", content: `{"version":2,"next_block":300}`, expectError: true},
+		{name: "garbage", content: "abc", expectError: true},
+		{name: "empty", content: "", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			progress, err := ParseProgress([]byte(test.content))
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectNext, progress.NextBlock)
+		})
+	}
+}
+
+func TestWriteProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := NewMerger(nil, nil, 0, 0, filepath.Join(dir, "progress"), false, "", 0, 100, "")
+	m.SetupBundle(150, 1000)
+	require.NotEmpty(t, m.RunID())
+
+	_, err = m.ReadProgress()
+	assert.True(t, os.IsNotExist(err))
+
+	tailTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, m.writeProgress(m.bundle, &OneBlockFile{num: 199, id: "aaaaaaaa", blockTime: tailTime}))
+
+	progress, err := m.ReadProgress()
+	require.NoError(t, err)
+	assert.Equal(t, ProgressVersion, progress.Version)
+	assert.Equal(t, uint64(200), progress.NextBlock)
+	assert.Equal(t, uint64(100), progress.LastMergedBundle)
+	assert.Equal(t, uint64(199), progress.TailBlockNum)
+	assert.Equal(t, "aaaaaaaa", progress.TailBlockID)
+	assert.True(t, tailTime.Equal(progress.TailBlockTime))
+	assert.Equal(t, m.RunID(), progress.RunID)
+	assert.Equal(t, uint64(150), progress.RangeStart)
+	assert.Equal(t, uint64(1000), progress.RangeStop)
+	assert.False(t, progress.StartedAt.After(progress.UpdatedAt))
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
+)
+
+// quarantineInvalidFiles waits for the downloads of the current bundle,
+// then moves every one-block file that was downloaded but could not be
+// decoded or validated to the quarantine store and removes it from the
+// bundle.
+//
+// It returns the number of files quarantined, callers must check the
+// bundle completeness again when it is not zero.
+func (m *Merger) quarantineInvalidFiles() (count int, err error) {
+	b := m.bundle
+	if err := b.downloadWaitGroup.Wait(); err != nil {
+		return 0, err
+	}
+
+	for filename, oneBlock := range b.fileList {
+		if oneBlock.err == nil {
+			continue
+		}
+
+		if err := m.quarantine(oneBlock); err != nil {
+			return count, fmt.Errorf("quarantining %q: %w", filename, err)
+		}
+		delete(b.fileList, filename)
+		count++
+
+		// the same block from another producer can take its place
+		for dupFilename, dup := range b.duplicates {
+			if dup.num == oneBlock.num && dup.id == oneBlock.id {
+				zlog.Info("replacing quarantined file with duplicate", zap.String("filename", filename), zap.String("duplicate_filename", dupFilename))
+				delete(b.duplicates, dupFilename)
+				b.addAndDownload(dup, m.sourceStore)
+				break
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (m *Merger) quarantine(oneBlock *OneBlockFile) error {
+	zlog.Warn("quarantining one-block file", zap.String("filename", oneBlock.name), zap.String("producer", oneBlock.producer), zap.Error(oneBlock.err))
+
+	// the original object is copied, it is only deleted from the source
+	// store once the copy succeeded
+	err := m.retryPolicy.Do("quarantine", m.Terminating(), func() error {
+		ctx, cancel := m.terminatingContext(WriteObjectTimeout)
+		defer cancel()
+
+		reader, err := m.sourceStore.OpenObject(ctx, oneBlock.name)
+		if err != nil {
+			return fmt.Errorf("opening file: %w", err)
+		}
+		defer reader.Close()
+
+		if err := m.quarantineStore.WriteObject(ctx, oneBlock.name, reader); err != nil {
+			return fmt.Errorf("writing file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	annotation := strings.Join([]string{
+		"filename: " + oneBlock.name,
+		"producer: " + oneBlock.producer,
+		"error: " + oneBlock.err.Error(),
+		"quarantined_at: " + time.Now().UTC().Format(time.RFC3339),
+		"",
+	}, "\n")
+	err = m.retryPolicy.Do("quarantine", m.Terminating(), func() error {
+		ctx, cancel := m.terminatingContext(WriteObjectTimeout)
+		defer cancel()
+		return m.quarantineAnnotationsStore.WriteObject(ctx, oneBlock.name+".error", strings.NewReader(annotation))
+	})
+	if err != nil {
+		return fmt.Errorf("writing annotation: %w", err)
+	}
+
+	// not added to the seen cache: another file holding the same block
+	// must still be merged, only this filename is skipped by listings
+	// until it is deleted
+	m.quarantined[oneBlock.name] = true
+
+	// the retention policy is skipped, a corrupt file must neither be
+	// archived for consumers nor kept in the source store
+	err = m.retryPolicy.Do("delete", m.Terminating(), func() error {
+		ctx, cancel := m.terminatingContext(DeleteObjectTimeout)
+		defer cancel()
+		return m.sourceStore.DeleteObject(ctx, oneBlock.name)
+	})
+	if err != nil && !IsNotExistError(err) {
+		zlog.Warn("cannot delete quarantined one-block file, it stays skipped by listings", zap.String("filename", oneBlock.name), zap.Error(err))
+		metrics.FailedDeletions.Inc()
+	}
+
+	metrics.QuarantinedFiles.Inc()
+	return nil
+}
+
+// forgetQuarantined drops the quarantined filenames of blocks that are
+// now too old to be listed as good files.
+func (m *Merger) forgetQuarantined() {
+	for filename := range m.quarantined {
+		num, _, _, _, err := parseFilename(filename)
+		if err != nil || m.seenBlocks.IsTooOld(num) {
+			delete(m.quarantined, filename)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantineInvalidFiles(t *testing.T) {
+	m, oneStore, _, cleanup := setupMerger(t)
+	defer cleanup()
+	m.seenBlocks.Reset()
+
+	qdir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(qdir)
+
+	quarantineStore, err := dstore.NewDBinStore(qdir)
+	require.NoError(t, err)
+	annotationsStore, err := dstore.NewSimpleStore(qdir)
+	require.NoError(t, err)
+	WithQuarantine(quarantineStore, annotationsStore)(m)
+	m.configureBundle(m.bundle)
+
+	var archived []string
+	archive := dstore.NewMockStore(func(base string, f io.Reader) error {
+		archived = append(archived, base)
+		return nil
+	})
+	m.janitor = newJanitor(oneStore, m.retryPolicy, RetentionPolicy{Mode: RetainArchive, ArchiveStore: archive}, 1, "")
+
+	duplicate101 := "0000000101-19700117T153112.5-4f66fd0241681ebbc119f97e952c1036b87b6e8f64f5c5d84c5c7a9bb1ebfdcc-dfe2e70d6c116a541101cecbb256d7402d62125f6ddc9b607d49edc989825c64"
+	writeOneBlockFile(testBlockForFile(blk100.filename), blk100.filename, oneStore)
+	writeOneBlockFile(testBlockForFile(blk102.filename), blk101.filename, oneStore) // mis-named
+	writeOneBlockFile(testBlockForFile(duplicate101), duplicate101, oneStore)
+
+	_, err = m.triageNewOneBlockFiles([]string{blk100.filename, blk101.filename, duplicate101})
+	require.NoError(t, err)
+	require.Len(t, m.bundle.duplicates, 1)
+
+	count, err := m.quarantineInvalidFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	ctx := context.Background()
+	exists, err := quarantineStore.FileExists(ctx, blk101.filename)
+	require.NoError(t, err)
+	assert.True(t, exists, "quarantined file")
+
+	exists, err = annotationsStore.FileExists(ctx, blk101.filename+".error")
+	require.NoError(t, err)
+	assert.True(t, exists, "annotation")
+
+	exists, err = oneStore.FileExists(ctx, blk101.filename)
+	require.NoError(t, err)
+	assert.False(t, exists, "removed from source store")
+	assert.Len(t, archived, 0, "retention policy skipped")
+	assert.Equal(t, 0, m.janitor.pendingCount())
+	assert.False(t, m.seenBlocks.SeenBefore(blk101.filename), "another file of the same block can still be merged")
+	assert.Equal(t, fileSeen, m.classifyFile(blk101.filename), "skipped by listings")
+	assert.Equal(t, fileGood, m.classifyFile(duplicate101), "valid copy of the quarantined block")
+
+	assert.Len(t, m.bundle.duplicates, 0)
+	assert.Contains(t, m.bundle.fileList, duplicate101, "duplicate replaces the quarantined file")
+	assert.NotContains(t, m.bundle.fileList, blk101.filename)
+
+	count, err = m.quarantineInvalidFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestQuarantineSkipsFailedDownloads(t *testing.T) {
+	m, oneStore, _, cleanup := setupMerger(t)
+	defer cleanup()
+	m.seenBlocks.Reset()
+
+	qdir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(qdir)
+
+	quarantineStore, err := dstore.NewDBinStore(qdir)
+	require.NoError(t, err)
+	annotationsStore, err := dstore.NewSimpleStore(qdir)
+	require.NoError(t, err)
+	WithQuarantine(quarantineStore, annotationsStore)(m)
+	m.retryPolicy = RetryPolicy{Attempts: 1}
+	m.configureBundle(m.bundle)
+
+	writeOneBlockFile(testBlockForFile(blk100.filename), blk100.filename, oneStore)
+	_, err = m.triageNewOneBlockFiles([]string{blk100.filename, blk101.filename}) // blk101 cannot be downloaded
+	require.NoError(t, err)
+
+	_, err = m.quarantineInvalidFiles()
+	assert.Error(t, err)
+
+	exists, err := quarantineStore.FileExists(context.Background(), blk101.filename)
+	require.NoError(t, err)
+	assert.False(t, exists, "not quarantined")
+	assert.Equal(t, fileGood, m.classifyFile(blk101.filename))
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+)
+
+// RetentionMode tells what happens to one-block files once they are
+// merged, or found too old by the listing.
+type RetentionMode int
+
+const (
+	// RetainNothing deletes the files right away.
+	RetainNothing RetentionMode = iota
+	// RetainBlocks keeps the files of the last `KeepBlocks` merged blocks.
+	RetainBlocks
+	// RetainDuration keeps the files of blocks produced less than
+	// `KeepDuration` ago.
+	RetainDuration
+	// RetainArchive moves the files to `ArchiveStore`.
+	RetainArchive
+)
+
+func ParseRetentionMode(in string) (RetentionMode, error) {
+	switch in {
+	case "", "delete":
+		return RetainNothing, nil
+	case "keep-blocks":
+		return RetainBlocks, nil
+	case "keep-duration":
+		return RetainDuration, nil
+	case "archive":
+		return RetainArchive, nil
+	}
+	return 0, fmt.Errorf("unknown retention mode %q, valid values are \"delete\", \"keep-blocks\", \"keep-duration\" and \"archive\"", in)
+}
+
+func (r RetentionMode) String() string {
+	switch r {
+	case RetainBlocks:
+		return "keep-blocks"
+	case RetainDuration:
+		return "keep-duration"
+	case RetainArchive:
+		return "archive"
+	}
+	return "delete"
+}
+
+type RetentionPolicy struct {
+	Mode         RetentionMode
+	KeepBlocks   uint64
+	KeepDuration time.Duration
+	ArchiveStore dstore.Store
+}
+
+// expired tells if the one-block file can leave the source store, given
+// `head`, the highest merged block.
+func (p RetentionPolicy) expired(filename string, head uint64, now time.Time) bool {
+	switch p.Mode {
+	case RetainBlocks:
+		blockNum, _, _, _, err := parseFilename(filename)
+		if err != nil {
+			return true // not a block file, nothing to keep
+		}
+		return blockNum+p.KeepBlocks <= head
+	case RetainDuration:
+		_, blockTime, _, _, err := parseFilename(filename)
+		if err != nil {
+			return true
+		}
+		return now.Sub(blockTime) >= p.KeepDuration
+	}
+	return true
+}
+
+// archive copies the one-block file to the archive store, before it is
+// deleted from the source store.
+func (p RetentionPolicy) archive(ctx context.Context, source dstore.Store, filename string) error {
+	if p.Mode != RetainArchive {
+		return nil
+	}
+
+	reader, err := source.OpenObject(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return p.ArchiveStore.WriteObject(ctx, filename, reader)
+}
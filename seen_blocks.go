@@ -15,38 +15,79 @@
 package merger
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
-	"os"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
 
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/merger/metrics"
 	"go.uber.org/zap"
 )
 
+// SeenBlockCacheVersion is the version of the on-disk format written by
+// `Save`, older versions are still read and migrated on the next save:
+// version 1 lists filenames, and version 0 is the legacy gob encoding of
+// the whole struct.
+const SeenBlockCacheVersion = 2
+
+// SeenBlockCache remembers the blocks merged recently, indexed by block
+// number, so files of already merged blocks are not merged again. Only
+// the ID of each block is kept, and the sorted list of numbers lets
+// `Truncate` only visit the blocks it evicts.
 type SeenBlockCache struct {
-	M           map[string]bool
-	filename    string
+	blocks      map[uint64][]string // block number -> IDs seen at that number
+	nums        []uint64            // sorted keys of `blocks`
+	idCount     int
+	memSize     int // approximate memory used by the entries
+	file        *stateFile
 	keepSize    uint64
 	HighestSeen uint64
 }
 
 func NewSeenBlockCache(filename string, keepSize uint64) (c *SeenBlockCache) {
-	var err error
-	c, err = loadSeenBlocks(filename)
+	return newSeenBlockCache(newLocalStateFile(filename), keepSize)
+}
+
+// NewSeenBlockCacheInStore keeps the cache in the `SeenBlocksStateObject`
+// object of `store` instead of a local file.
+func NewSeenBlockCacheInStore(store dstore.Store, keepSize uint64) (c *SeenBlockCache) {
+	return newSeenBlockCache(newStoreStateFile(store, SeenBlocksStateObject), keepSize)
+}
+
+func newSeenBlockCache(file *stateFile, keepSize uint64) (c *SeenBlockCache) {
+	content, err := file.read()
+	if err == nil {
+		c, err = decodeSeenBlockCache(content)
+	}
 	if err != nil {
-		zlog.Info("cannot load seen_block_cache", zap.String("filename", filename), zap.Error(err))
-		c = &SeenBlockCache{
-			M: make(map[string]bool),
-		}
+		zlog.Info("cannot load seen_block_cache", zap.Stringer("filename", file), zap.Error(err))
+		c = newEmptySeenBlockCache()
 	} else {
-		zlog.Info("loaded seen_block_cache", zap.String("filename", filename), zap.Int("length", len(c.M)))
+		zlog.Info("loaded seen_block_cache", zap.Stringer("filename", file), zap.Int("length", c.idCount))
 	}
-	c.filename = filename
+	c.file = file
 	c.keepSize = keepSize
+	c.reportMetrics()
 	return
 }
 
+func newEmptySeenBlockCache() *SeenBlockCache {
+	return &SeenBlockCache{
+		blocks: make(map[uint64][]string),
+	}
+}
+
 func (c *SeenBlockCache) Reset() {
-	c.M = make(map[string]bool)
+	c.blocks = make(map[uint64][]string)
+	c.nums = nil
+	c.idCount = 0
+	c.memSize = 0
 	c.HighestSeen = 0
+	c.reportMetrics()
 }
 
 func (c *SeenBlockCache) IsTooOld(num uint64) bool {
@@ -55,24 +96,74 @@ func (c *SeenBlockCache) IsTooOld(num uint64) bool {
 	}
 	return false
 }
+
+// SeenBefore tells if the block of this one-block file was seen, even
+// under another filename, like the same block from another producer.
+// Blocks are identified by number and ID rather than by filename, as
+// keeping every filename is what made the cache large, and a block
+// merged once must not be merged again from another copy. A fork block
+// of the same number has another ID and is not seen.
 func (c *SeenBlockCache) SeenBefore(filename string) bool {
-	if _, ok := c.M[filename]; ok {
-		return true
+	num, _, id, _, err := parseFilename(filename)
+	if err != nil {
+		return false
+	}
+	return c.seen(num, id)
+}
+
+func (c *SeenBlockCache) seen(num uint64, id string) bool {
+	for _, seenID := range c.blocks[num] {
+		if seenID == id {
+			return true
+		}
 	}
 	return false
 }
 
 func (c *SeenBlockCache) Add(filename string) {
-	num := fileToNum(filename)
+	num, _, id, _, err := parseFilename(filename)
+	if err != nil {
+		zlog.Warn("cannot add invalid filename to seen_block_cache", zap.String("filename", filename), zap.Error(err))
+		return
+	}
+	c.add(num, id)
+	c.reportMetrics()
+}
+
+func (c *SeenBlockCache) add(num uint64, id string) {
 	if num > c.HighestSeen {
 		c.HighestSeen = num
 	}
-	c.M[filename] = true
+	if c.seen(num, id) {
+		return
+	}
+
+	if _, found := c.blocks[num]; !found {
+		c.memSize += blockEntrySize
+		// blocks are mostly added in increasing order, append is the common case
+		i := sort.Search(len(c.nums), func(i int) bool { return c.nums[i] >= num })
+		c.nums = append(c.nums, 0)
+		copy(c.nums[i+1:], c.nums[i:])
+		c.nums[i] = num
+	}
+	c.blocks[num] = append(c.blocks[num], id)
+	c.idCount++
+	c.memSize += idEntrySize + len(id)
 }
 
-func fileToNum(filename string) uint64 {
-	blockNum, _, _, _, _ := parseFilename(filename)
-	return blockNum
+// IDsBelow returns the block ID suffixes of all the seen blocks
+// numbered below `num`.
+func (c *SeenBlockCache) IDsBelow(num uint64) map[string]bool {
+	out := make(map[string]bool)
+	for _, blockNum := range c.nums {
+		if blockNum >= num {
+			break
+		}
+		for _, id := range c.blocks[blockNum] {
+			out[id] = true
+		}
+	}
+	return out
 }
 
 func (c *SeenBlockCache) lowBoundary() uint64 {
@@ -84,32 +175,187 @@ func (c *SeenBlockCache) lowBoundary() uint64 {
 
 }
 
+// Truncate evicts the blocks below the low boundary.
 func (c *SeenBlockCache) Truncate() {
-	for filename := range c.M {
-		if fileToNum(filename) < c.lowBoundary() {
-			delete(c.M, filename)
+	low := c.lowBoundary()
+	cut := sort.Search(len(c.nums), func(i int) bool { return c.nums[i] >= low })
+	for _, num := range c.nums[:cut] {
+		for _, id := range c.blocks[num] {
+			c.idCount--
+			c.memSize -= idEntrySize + len(id)
 		}
+		c.memSize -= blockEntrySize
+		delete(c.blocks, num)
 	}
+	c.nums = c.nums[cut:] // the backing array is released by later appends
+	c.reportMetrics()
 }
 
-func loadSeenBlocks(filename string) (decoded *SeenBlockCache, err error) {
-	f, err := os.Open(filename)
+// Len returns the number of blocks IDs in the cache.
+func (c *SeenBlockCache) Len() int {
+	return c.idCount
+}
+
+// approximate memory used by the entries of the cache
+const (
+	blockEntrySize = 8 + 24 + 8 // map key, IDs slice header, `nums` entry
+	idEntrySize    = 16         // string header, the ID bytes are added
+)
+
+func (c *SeenBlockCache) reportMetrics() {
+	metrics.SeenCacheBlocks.SetUint64(uint64(c.idCount))
+	metrics.SeenCacheBytes.SetUint64(uint64(c.memSize))
+}
+
+// seenBlockCacheFile is the versioned on-disk envelope, `Checksum` is
+// the hex-encoded SHA-256 of `Payload`.
+type seenBlockCacheFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type seenBlockCachePayload struct {
+	HighestSeen uint64            `json:"highest_seen"`
+	Blocks      []SeenBlocksAtNum `json:"blocks,omitempty"`
+	Filenames   []string          `json:"filenames,omitempty"` // version 1
+}
+
+// SeenBlocksAtNum holds the IDs of the blocks seen at a block number.
+type SeenBlocksAtNum struct {
+	Num uint64   `json:"num"`
+	IDs []string `json:"ids"`
+}
+
+// LoadSeenBlockCache reads a seen blocks cache file, in the current
+// format or in an older one. Unlike `NewSeenBlockCache`, a missing or
+// invalid file is an error.
+func LoadSeenBlockCache(filename string) (*SeenBlockCache, error) {
+	return loadSeenBlockCache(newLocalStateFile(filename))
+}
+
+// LoadSeenBlockCacheFromStore reads the seen blocks cache of a merger
+// configured with `WithStateStore`.
+func LoadSeenBlockCacheFromStore(store dstore.Store) (*SeenBlockCache, error) {
+	return loadSeenBlockCache(newStoreStateFile(store, SeenBlocksStateObject))
+}
+
+func loadSeenBlockCache(file *stateFile) (*SeenBlockCache, error) {
+	content, err := file.read()
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer f.Close()
 
-	dataDecoder := gob.NewDecoder(f)
-	err = dataDecoder.Decode(&decoded)
-	return
+	c, err := decodeSeenBlockCache(content)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q: %w", file, err)
+	}
+	c.file = file
+	return c, nil
+}
+
+func decodeSeenBlockCache(content []byte) (*SeenBlockCache, error) {
+	if len(content) == 0 || content[0] != '{' {
+		return decodeLegacySeenBlockCache(content)
+	}
+
+	var file seenBlockCacheFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	if file.Version < 1 || file.Version > SeenBlockCacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", file.Version)
+	}
+
+	sum := sha256.Sum256(file.Payload)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return nil, fmt.Errorf("checksum mismatch, file is corrupted")
+	}
+
+	var payload seenBlockCachePayload
+	if err := json.Unmarshal(file.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	c := newEmptySeenBlockCache()
+	for _, block := range payload.Blocks {
+		for _, id := range block.IDs {
+			c.add(block.Num, id)
+		}
+	}
+	c.addFilenames(payload.Filenames)
+	c.HighestSeen = payload.HighestSeen
+	return c, nil
+}
+
+// legacySeenBlockCache is the struct encoded by the gob format.
+type legacySeenBlockCache struct {
+	M           map[string]bool
+	HighestSeen uint64
+}
+
+func decodeLegacySeenBlockCache(content []byte) (*SeenBlockCache, error) {
+	var decoded legacySeenBlockCache
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	c := newEmptySeenBlockCache()
+	filenames := make([]string, 0, len(decoded.M))
+	for filename := range decoded.M {
+		filenames = append(filenames, filename)
+	}
+	c.addFilenames(filenames)
+	c.HighestSeen = decoded.HighestSeen
+
+	zlog.Info("loaded seen_block_cache in legacy format, it will be migrated on next save")
+	return c, nil
+}
+
+func (c *SeenBlockCache) addFilenames(filenames []string) {
+	for _, filename := range filenames {
+		num, _, id, _, err := parseFilename(filename)
+		if err != nil {
+			continue
+		}
+		c.add(num, id)
+	}
+}
+
+// Encode returns the cache in the current on-disk format.
+func (c *SeenBlockCache) Encode() ([]byte, error) {
+	payload, err := json.Marshal(&seenBlockCachePayload{
+		HighestSeen: c.HighestSeen,
+		Blocks:      c.Blocks(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(payload)
+	return json.Marshal(&seenBlockCacheFile{
+		Version:  SeenBlockCacheVersion,
+		Checksum: hex.EncodeToString(sum[:]),
+		Payload:  payload,
+	})
+}
+
+// Blocks returns the seen block IDs, by increasing block number.
+func (c *SeenBlockCache) Blocks() []SeenBlocksAtNum {
+	out := make([]SeenBlocksAtNum, 0, len(c.nums))
+	for _, num := range c.nums {
+		ids := append([]string(nil), c.blocks[num]...)
+		sort.Strings(ids)
+		out = append(out, SeenBlocksAtNum{Num: num, IDs: ids})
+	}
+	return out
 }
 
+// Save writes the cache atomically, a crash never leaves a truncated file.
 func (c *SeenBlockCache) Save() error {
-	f, err := os.Create(c.filename)
+	content, err := c.Encode()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	dataEncoder := gob.NewEncoder(f)
-	return dataEncoder.Encode(c)
+	return c.file.write(content)
 }
@@ -0,0 +1,192 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeenBlockCacheSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "seen.json")
+
+	c := NewSeenBlockCache(filename, 100)
+	c.Add(blk100.filename)
+	c.Add(blk101.filename)
+	require.NoError(t, c.Save())
+
+	loaded := NewSeenBlockCache(filename, 100)
+	assert.Equal(t, uint64(101), loaded.HighestSeen)
+	assert.Equal(t, []SeenBlocksAtNum{{Num: 100, IDs: []string{blk100.id}}, {Num: 101, IDs: []string{blk101.id}}}, loaded.Blocks())
+	assert.Equal(t, uint64(100), loaded.keepSize)
+
+	// a corrupted file is rejected
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filename, bytes.Replace(content, []byte(`"num":101`), []byte(`"num":102`), 1), 0644))
+	_, err = LoadSeenBlockCache(filename)
+	assert.Error(t, err)
+}
+
+func TestSeenBlockCacheLegacyMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "seen.gob")
+
+	legacy := &legacySeenBlockCache{M: map[string]bool{blk100.filename: true}, HighestSeen: 100}
+	buffer := bytes.NewBuffer(nil)
+	require.NoError(t, gob.NewEncoder(buffer).Encode(legacy))
+	require.NoError(t, ioutil.WriteFile(filename, buffer.Bytes(), 0644))
+
+	c := NewSeenBlockCache(filename, 100)
+	assert.Equal(t, uint64(100), c.HighestSeen)
+	assert.True(t, c.SeenBefore(blk100.filename))
+
+	require.NoError(t, c.Save())
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"version":2`)
+
+	c, err = LoadSeenBlockCache(filename)
+	require.NoError(t, err)
+	assert.True(t, c.SeenBefore(blk100.filename))
+	require.NoError(t, c.Save(), "saved back to the file")
+}
+
+func TestSeenBlockCacheInStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := dstore.NewSimpleStore(dir)
+	require.NoError(t, err)
+
+	c := NewSeenBlockCacheInStore(store, 100)
+	assert.Equal(t, 0, c.Len())
+	c.Add(blk100.filename)
+	require.NoError(t, c.Save())
+
+	c = NewSeenBlockCacheInStore(store, 100)
+	assert.True(t, c.SeenBefore(blk100.filename))
+	assert.Equal(t, uint64(100), c.HighestSeen)
+
+	m := NewMerger(store, store, 0, 0, "", false, "", 0, 100, "", WithStateStore(store))
+	assert.True(t, m.seenBlocks.SeenBefore(blk100.filename))
+
+	c, err = LoadSeenBlockCacheFromStore(store)
+	require.NoError(t, err)
+	assert.True(t, c.SeenBefore(blk100.filename))
+	c.Add(blk101.filename)
+	require.NoError(t, c.Save(), "saved back to the store")
+	assert.True(t, NewSeenBlockCacheInStore(store, 100).SeenBefore(blk101.filename))
+
+	empty, err := dstore.NewSimpleStore(filepath.Join(dir, "empty"))
+	require.NoError(t, err)
+	_, err = LoadSeenBlockCacheFromStore(empty)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = m.ReadProgress()
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, m.progress.write([]byte("200")))
+	progress, err := m.ReadProgress()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), progress.NextBlock)
+}
+
+func TestStateStoreRetries(t *testing.T) {
+	failures := 2
+	store := dstore.NewMockStore(func(base string, f io.Reader) error {
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("store unavailable")
+		}
+		return nil
+	})
+
+	policy := RetryPolicy{Attempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	m := NewMerger(store, store, 0, 0, "", false, "", 0, 100, "", WithStateStore(store), WithRetryPolicy(policy))
+	require.NoError(t, m.progress.write([]byte("200")))
+	assert.Equal(t, 0, failures)
+
+	failures = 10
+	m.Shutdown(nil)
+	err := m.progress.write([]byte("300"))
+	require.Error(t, err)
+	assert.Equal(t, 9, failures, "no retry once terminating")
+}
+
+func TestSeenBlockCacheSeenBefore(t *testing.T) {
+	c := NewSeenBlockCache("", 10)
+	c.Add("0000000100-20170701T122141.0-aaaaaaaa-00000000-99-producer1")
+
+	assert.True(t, c.SeenBefore("0000000100-20170701T122141.0-aaaaaaaa-00000000-99-producer1"), "same file")
+	assert.True(t, c.SeenBefore("0000000100-20170701T122141.0-aaaaaaaa-00000000-99-producer2"), "same block from another producer")
+	assert.True(t, c.SeenBefore("0000000100-20170701T122141.0-aaaaaaaa-00000000"), "same block in the v0 schema")
+	assert.False(t, c.SeenBefore("0000000100-20170701T122141.0-bbbbbbbb-00000000-99-producer1"), "fork block of the same number")
+	assert.False(t, c.SeenBefore("0000000101-20170701T122141.5-aaaaaaaa-00000000"), "same ID at another number")
+}
+
+func TestSeenBlockCacheTruncate(t *testing.T) {
+	c := NewSeenBlockCache("", 2)
+	c.Add("0000000100-20170701T122141.0-aaaaaaaa-00000000")
+	c.Add("0000000100-20170701T122141.0-bbbbbbbb-00000000")
+	c.Add("0000000101-20170701T122141.5-cccccccc-aaaaaaaa")
+	c.Add("0000000103-20170701T122142.5-eeeeeeee-dddddddd")
+	c.Add("0000000102-20170701T122142.0-dddddddd-cccccccc")
+	assert.Equal(t, 5, c.Len())
+	assert.Equal(t, uint64(103), c.HighestSeen)
+
+	// same block from another producer
+	assert.True(t, c.SeenBefore("0000000100-20170701T122141.0-bbbbbbbb-00000000-99-other"))
+	assert.False(t, c.SeenBefore("0000000100-20170701T122141.0-ffffffff-00000000"))
+
+	c.Truncate()
+	assert.Equal(t, 3, c.Len())
+	assert.False(t, c.SeenBefore("0000000100-20170701T122141.0-aaaaaaaa-00000000"))
+	assert.True(t, c.SeenBefore("0000000101-20170701T122141.5-cccccccc-aaaaaaaa"))
+	assert.Equal(t, map[string]bool{"cccccccc": true, "dddddddd": true}, c.IDsBelow(103))
+}
+
+func TestSeenBlockCacheReadVersion1(t *testing.T) {
+	payload := []byte(`{"highest_seen":101,"filenames":["` + blk100.filename + `","` + blk101.filename + `"]}`)
+	sum := sha256.Sum256(payload)
+	content, err := json.Marshal(&seenBlockCacheFile{Version: 1, Checksum: hex.EncodeToString(sum[:]), Payload: payload})
+	require.NoError(t, err)
+
+	c, err := decodeSeenBlockCache(content)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(101), c.HighestSeen)
+	assert.True(t, c.SeenBefore(blk100.filename))
+	assert.True(t, c.SeenBefore(blk101.filename))
+}
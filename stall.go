@@ -0,0 +1,228 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
+)
+
+// StallReport describes the hole preventing a bundle from completing.
+type StallReport struct {
+	BundleLowerBlock uint64    `json:"bundle_lower_block"`
+	StalledSince     time.Time `json:"stalled_since"`
+
+	// MissingBlockID is the block the canonical chain links to but no
+	// file holds, MissingBlockNum is its number, 0 on sparse chains.
+	MissingBlockID  string `json:"missing_block_id"`
+	MissingBlockNum uint64 `json:"missing_block_num"`
+	// MissingBlockNums are the numbers below the hole without any file,
+	// never set on sparse chains where numbers can be skipped.
+	MissingBlockNums []uint64 `json:"missing_block_nums,omitempty"`
+
+	FilesBelow []string `json:"files_below,omitempty"` // files of the highest number below the hole
+	FilesAbove []string `json:"files_above,omitempty"` // lowest file of the canonical chain above the hole
+
+	// CompetingForkFiles are files at the missing number with another
+	// ID, CompetingForkReachesLowerBound tells if one of them links down
+	// to the lower bound of the bundle, so their fork could complete it.
+	CompetingForkFiles             []string `json:"competing_fork_files,omitempty"`
+	CompetingForkReachesLowerBound bool     `json:"competing_fork_reaches_lower_bound"`
+}
+
+func (r *StallReport) fields() []zap.Field {
+	return []zap.Field{
+		zap.Uint64("bundle_lower_block", r.BundleLowerBlock),
+		zap.Time("stalled_since", r.StalledSince),
+		zap.String("missing_block_id", r.MissingBlockID),
+		zap.Uint64("missing_block_num", r.MissingBlockNum),
+		zap.Int("missing_block_nums_count", len(r.MissingBlockNums)),
+		zap.Strings("files_below", r.FilesBelow),
+		zap.Strings("files_above", r.FilesAbove),
+		zap.Strings("competing_fork_files", r.CompetingForkFiles),
+		zap.Bool("competing_fork_reaches_lower_bound", r.CompetingForkReachesLowerBound),
+	}
+}
+
+func (r *StallReport) summary(now time.Time) string {
+	return fmt.Sprintf("bundle %d stalled for %s, missing block %d (%s), %d block numbers without any file, %d competing fork files",
+		r.BundleLowerBlock, now.Sub(r.StalledSince).Round(time.Second), r.MissingBlockNum, r.MissingBlockID, len(r.MissingBlockNums), len(r.CompetingForkFiles))
+}
+
+// holeReport follows the canonical chain down from the upper block ID,
+// like `isComplete`, and describes where it breaks.
+func (b *Bundle) holeReport() *StallReport {
+	byID := make(map[string]*OneBlockFile, len(b.fileList))
+	byNum := make(map[uint64][]*OneBlockFile)
+	for _, f := range b.fileList {
+		byID[f.id] = f
+		byNum[f.num] = append(byNum[f.num], f)
+	}
+
+	report := &StallReport{
+		BundleLowerBlock: b.lowerBlock,
+		MissingBlockID:   b.upperBlockID,
+	}
+
+	// first number above the hole
+	top := b.upperBlock()
+	if b.sparse {
+		top = b.upperBlockNum
+	}
+	seen := make(map[string]bool)
+	for f := byID[b.upperBlockID]; f != nil && !seen[f.id]; f = byID[f.previousID] {
+		seen[f.id] = true
+		top = f.num
+		report.MissingBlockID = f.previousID
+		report.FilesAbove = []string{f.name}
+	}
+
+	bottom := b.lowerBlock
+	if first, contained := b.chainStart(); contained {
+		bottom = first
+	}
+
+	var highestBelow uint64
+	var foundBelow bool
+	for num := range byNum {
+		if num < top && (!foundBelow || num > highestBelow) {
+			highestBelow, foundBelow = num, true
+		}
+	}
+	if foundBelow {
+		report.FilesBelow = sortedNames(byNum[highestBelow])
+	}
+
+	if b.sparse || top == 0 {
+		return report
+	}
+
+	report.MissingBlockNum = top - 1
+	for num := bottom; num < top; num++ {
+		if len(byNum[num]) == 0 {
+			report.MissingBlockNums = append(report.MissingBlockNums, num)
+		}
+	}
+
+	for _, f := range byNum[report.MissingBlockNum] {
+		if f.id == report.MissingBlockID {
+			continue
+		}
+		report.CompetingForkFiles = append(report.CompetingForkFiles, f.name)
+
+		lowest := f.num
+		linked := map[string]bool{}
+		for g := f; g != nil && !linked[g.id]; g = byID[g.previousID] {
+			linked[g.id] = true
+			lowest = g.num
+		}
+		if lowest <= bottom {
+			report.CompetingForkReachesLowerBound = true
+		}
+	}
+	sort.Strings(report.CompetingForkFiles)
+	return report
+}
+
+func sortedNames(files []*OneBlockFile) (out []string) {
+	for _, f := range files {
+		out = append(out, f.name)
+	}
+	sort.Strings(out)
+	return
+}
+
+// detectStall is called on each attempt to complete the bundle: once a
+// hole blocks it for longer than the stall timeout, the hole is
+// reported in logs, metrics, health checks and to the webhook.
+func (m *Merger) detectStall(hole bool) {
+	if !hole {
+		if !m.stallStart.IsZero() {
+			zlog.Info("bundle no longer blocked by a hole", zap.Uint64("bundle_lower_block", m.stallBundle), zap.Duration("blocked_for", time.Since(m.stallStart)))
+		}
+		m.stallStart = time.Time{}
+		m.setStallReport(nil)
+		return
+	}
+
+	if m.stallStart.IsZero() || m.stallBundle != m.bundle.lowerBlock {
+		m.stallStart = time.Now()
+		m.stallBundle = m.bundle.lowerBlock
+		m.stallNotified = false
+	}
+	if m.stallTimeout <= 0 || time.Since(m.stallStart) < m.stallTimeout {
+		return
+	}
+
+	report := m.bundle.holeReport()
+	report.StalledSince = m.stallStart
+	m.setStallReport(report)
+
+	if !m.stallNotified {
+		m.stallNotified = true
+		zlog.Warn("bundle stalled on a hole in one-block files", report.fields()...)
+		if m.stallWebhookURL != "" {
+			go m.notifyStall(report)
+		}
+	}
+}
+
+func (m *Merger) setStallReport(report *StallReport) {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	m.health.stall = report
+
+	if report == nil {
+		metrics.BundleStalled.SetUint64(0)
+		metrics.StallMissingBlocks.SetUint64(0)
+		return
+	}
+	metrics.BundleStalled.SetUint64(1)
+	metrics.StallMissingBlocks.SetUint64(uint64(len(report.MissingBlockNums)))
+}
+
+// StallReport returns the hole blocking the current bundle for longer
+// than the stall timeout, nil when there is none.
+func (m *Merger) StallReport() *StallReport {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	return m.health.stall
+}
+
+func (m *Merger) notifyStall(report *StallReport) {
+	content, err := json.Marshal(report)
+	if err == nil {
+		client := &http.Client{Timeout: StallWebhookTimeout}
+		var resp *http.Response
+		resp, err = client.Post(m.stallWebhookURL, "application/json", bytes.NewReader(content))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		zlog.Warn("cannot notify stall webhook", zap.Uint64("bundle_lower_block", report.BundleLowerBlock), zap.Error(err))
+		metrics.StallWebhookFailures.Inc()
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoleReport(t *testing.T) {
+	tests := []struct {
+		name         string
+		fileList     func() map[string]*OneBlockFile
+		expectReport *StallReport
+	}{
+		{
+			name: "hole",
+			fileList: func() map[string]*OneBlockFile {
+				files := contiguousBlocksGetter(100, 179)()
+				for k, v := range contiguousBlocksGetter(182, 199)() {
+					files[k] = v
+				}
+				return files
+			},
+			expectReport: &StallReport{
+				BundleLowerBlock: 100,
+				MissingBlockID:   numToID(181, "a"),
+				MissingBlockNum:  181,
+				MissingBlockNums: []uint64{180, 181},
+				FilesBelow:       []string{numToID(179, "a")},
+				FilesAbove:       []string{numToID(182, "a")},
+			},
+		},
+		{
+			name:     "upper block missing",
+			fileList: contiguousBlocksGetter(100, 198),
+			expectReport: &StallReport{
+				BundleLowerBlock: 100,
+				MissingBlockID:   numToID(199, "a"),
+				MissingBlockNum:  199,
+				MissingBlockNums: []uint64{199},
+				FilesBelow:       []string{numToID(198, "a")},
+			},
+		},
+		{
+			name: "competing fork",
+			fileList: func() map[string]*OneBlockFile {
+				files := contiguousBlocksGetter(100, 179)()
+				for k, v := range contiguousBlocksGetter(181, 199)() {
+					files[k] = v
+				}
+				fork := forkBlkFile(180, "b", "a")
+				files[fork.name] = fork
+				return files
+			},
+			expectReport: &StallReport{
+				BundleLowerBlock:               100,
+				MissingBlockID:                 numToID(180, "a"),
+				MissingBlockNum:                180,
+				FilesBelow:                     []string{numToID(180, "b")},
+				FilesAbove:                     []string{numToID(181, "a")},
+				CompetingForkFiles:             []string{numToID(180, "b")},
+				CompetingForkReachesLowerBound: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBundle(100, 100)
+			b.fileList = test.fileList()
+			b.upperBlockID = numToID(199, "a")
+
+			report := b.holeReport()
+			report.FilesBelow = namesToIDs(b, report.FilesBelow)
+			report.FilesAbove = namesToIDs(b, report.FilesAbove)
+			report.CompetingForkFiles = namesToIDs(b, report.CompetingForkFiles)
+			assert.Equal(t, test.expectReport, report)
+		})
+	}
+}
+
+// namesToIDs replaces filenames, which contain the current time in tests, by block IDs
+func namesToIDs(b *Bundle, names []string) (out []string) {
+	for _, name := range names {
+		for _, f := range b.fileList {
+			if f.name == name {
+				out = append(out, f.id)
+			}
+		}
+	}
+	return
+}
+
+func TestDetectStall(t *testing.T) {
+	received := make(chan *StallReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := &StallReport{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(report))
+		received <- report
+	}))
+	defer server.Close()
+
+	m := NewMerger(nil, nil, 0, 0, "", false, "", 0, 100, "", WithStallDetection(time.Millisecond, server.URL))
+	m.bundle = NewBundle(100, 100)
+	m.bundle.fileList = contiguousBlocksGetter(100, 198)()
+	m.bundle.upperBlockID = numToID(199, "a")
+
+	m.detectStall(true)
+	assert.Nil(t, m.StallReport(), "not stalled before the timeout")
+
+	time.Sleep(5 * time.Millisecond)
+	m.detectStall(true)
+	require.NotNil(t, m.StallReport())
+	assert.Equal(t, uint64(199), m.StallReport().MissingBlockNum)
+
+	select {
+	case report := <-received:
+		assert.Equal(t, uint64(100), report.BundleLowerBlock)
+		assert.Equal(t, numToID(199, "a"), report.MissingBlockID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	m.detectStall(false)
+	assert.Nil(t, m.StallReport())
+}
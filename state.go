@@ -0,0 +1,118 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"github.com/dfuse-io/dstore"
+)
+
+// Names of the objects holding the merger state in a state store.
+const (
+	SeenBlocksStateObject = "seen_blocks.json"
+	ProgressStateObject   = "progress"
+)
+
+// stateFile is a small file holding merger state, either on the local
+// filesystem or, for mergers running on stateless nodes, in a store.
+type stateFile struct {
+	path string // local path, when store is nil
+
+	store       dstore.Store
+	name        string
+	retryPolicy RetryPolicy
+	terminating <-chan struct{} // stops retries and cancels store operations, never closed when nil
+}
+
+func newLocalStateFile(path string) *stateFile {
+	if path == "" {
+		return nil
+	}
+	return &stateFile{path: path}
+}
+
+func newStoreStateFile(store dstore.Store, name string) *stateFile {
+	return &stateFile{store: store, name: name, retryPolicy: DefaultRetryPolicy()}
+}
+
+// setRetryPolicy makes the store operations follow the merger's retry
+// policy and shutdown.
+func (f *stateFile) setRetryPolicy(policy RetryPolicy, terminating <-chan struct{}) {
+	if f == nil {
+		return
+	}
+	f.retryPolicy = policy
+	f.terminating = terminating
+}
+
+func (f *stateFile) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.store != nil {
+		return f.store.ObjectPath(f.name)
+	}
+	return f.path
+}
+
+// read returns the content of the file, with an error satisfying
+// `os.IsNotExist` when it does not exist.
+func (f *stateFile) read() ([]byte, error) {
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+	if f.store == nil {
+		return ioutil.ReadFile(f.path)
+	}
+
+	var content []byte
+	err := f.retryPolicy.Do("read_state", f.terminating, func() error {
+		ctx, cancel := contextWithCancelOn(f.terminating, GetObjectTimeout)
+		defer cancel()
+
+		reader, err := f.store.OpenObject(ctx, f.name)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		content, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if IsNotExistError(err) {
+		return nil, os.ErrNotExist
+	}
+	return content, err
+}
+
+// write replaces the content of the file atomically, stores only make
+// objects visible once completely written.
+func (f *stateFile) write(content []byte) error {
+	if f == nil {
+		return nil
+	}
+	if f.store == nil {
+		return writeFileAtomic(f.path, content)
+	}
+
+	return f.retryPolicy.Do("write_state", f.terminating, func() error {
+		ctx, cancel := contextWithCancelOn(f.terminating, WriteObjectTimeout)
+		defer cancel()
+		return f.store.WriteObject(ctx, f.name, bytes.NewReader(content))
+	})
+}
@@ -16,32 +16,139 @@ package merger
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"strconv"
 	"strings"
 
+	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/dstore"
 	"go.uber.org/zap"
 )
 
+// HoleError is returned by `FindNextBaseBlock` when merged files are
+// missing between two merged files of the destination store, like
+// between the ranges of mergers running in parallel in batch mode.
+type HoleError struct {
+	After  uint64 // last merged file before the hole
+	Before uint64 // first merged file after the hole
+}
+
+func (e *HoleError) Error() string {
+	return fmt.Sprintf("hole was found between %d and %d", e.After, e.Before)
+}
+
+// lastMergedBlockIDs returns the IDs of the blocks of the last merged
+// file below `num` holding any, going back over the merged files of
+// bundles whose slots were all skipped.
+func (m *Merger) lastMergedBlockIDs(num uint64) ([]string, error) {
+	for base := num; base >= m.chunkSize && base > m.minimalBlockNum; {
+		base -= m.chunkSize
+		ids, err := m.readMergedBlockIDs(base)
+		if err != nil {
+			if IsNotExistError(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if len(ids) > 0 {
+			return ids, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Merger) readMergedBlockIDs(base uint64) (ids []string, err error) {
+	ctx, cancel := m.terminatingContext(GetObjectTimeout)
+	defer cancel()
+
+	reader, err := m.destStore.OpenObject(ctx, m.mergedLayout.blockNumToStr(base))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	blockReader, err := bstream.GetBlockReaderFactory.New(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read merged file %d: %s", base, err)
+	}
+	for {
+		block, err := blockReader.Read()
+		if block != nil {
+			ids = append(ids, block.Id)
+		}
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read merged file %d: %s", base, err)
+		}
+	}
+}
+
 // findNextBaseBlock will return an error if there is a gap found ...
 func (m *Merger) FindNextBaseBlock() (uint64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), ListFilesTimeout)
 	defer cancel()
 
-	prefix := highestFilePrefix(ctx, m.destStore, m.minimalBlockNum, m.chunkSize)
-	zlog.Debug("find_next_base looking with prefix", zap.String("prefix", prefix))
+	next := m.minimalBlockNum
+	if firstBundle := m.firstStreamableBlock - m.firstStreamableBlock%m.chunkSize; firstBundle > next {
+		next = firstBundle
+	}
+
+	// a store can contain files of older layouts followed by files of
+	// the current one, each layout continues where the previous ended
+	for _, layout := range m.mergedLayout.readableLayouts() {
+		var err error
+		next, err = m.findNextBaseBlockWithLayout(ctx, layout, next)
+		if err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+// findNextBaseBlockFrom returns the first bundle at or above `from`
+// missing from the destination store. Merged files found after a hole
+// above it belong to other ranges and are ignored.
+func (m *Merger) findNextBaseBlockFrom(from uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ListFilesTimeout)
+	defer cancel()
+
+	next := from
+	for _, layout := range m.mergedLayout.readableLayouts() {
+		if !fileExistWithPrefix(ctx, layout, layout.blockNumToStr(next), m.destStore) {
+			continue
+		}
+
+		var err error
+		next, err = m.findNextBaseBlockWithLayout(ctx, layout, next)
+		var hole *HoleError
+		if err != nil && !errors.As(err, &hole) {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+func (m *Merger) findNextBaseBlockWithLayout(ctx context.Context, layout FilenameLayout, minimalBlockNum uint64) (uint64, error) {
+	prefix := highestFilePrefix(ctx, m.destStore, layout, minimalBlockNum, m.chunkSize)
+	zlog.Debug("find_next_base looking with prefix", zap.String("prefix", prefix), zap.Stringer("layout", layout))
 	var lastNumber uint64
 	foundAny := false
 	err := m.destStore.Walk(ctx, prefix, ".tmp", func(filename string) error {
-		fileNumberVal, err := strconv.ParseUint(filename, 10, 32)
+		if len(filename) != layout.digits() {
+			return nil
+		}
+		fileNumberVal, err := strconv.ParseUint(filename, 10, 64)
 		if err != nil {
 			zlog.Warn("findNextBaseBlock skipping unknown file", zap.String("filename", filename))
 			return nil
 		}
 		fileNumber := fileNumberVal
-		if fileNumber < m.minimalBlockNum {
+		if fileNumber < minimalBlockNum {
 			return nil
 		}
 		foundAny = true
@@ -50,7 +157,7 @@ func (m *Merger) FindNextBaseBlock() (uint64, error) {
 			lastNumber = fileNumber
 		} else {
 			if fileNumber != lastNumber+m.chunkSize {
-				return fmt.Errorf("hole was found between %d and %d", lastNumber, fileNumber)
+				return &HoleError{After: lastNumber, Before: fileNumber}
 			}
 			lastNumber = fileNumber
 		}
@@ -60,15 +167,15 @@ func (m *Merger) FindNextBaseBlock() (uint64, error) {
 		zlog.Error("find_next_base_block found hole", zap.Error(err))
 	}
 	if !foundAny {
-		return m.minimalBlockNum, err
+		return minimalBlockNum, err
 	}
 
 	return lastNumber + m.chunkSize, err
 }
 
-func getLeadingZeroes(blockNum uint64) (leadingZeros int) {
-	zlog.Debug("looking for filename", zap.String("filename", fileNameForBlocksBundle(int64(blockNum))))
-	for i, digit := range fileNameForBlocksBundle(int64(blockNum)) {
+func getLeadingZeroes(layout FilenameLayout, blockNum uint64) (leadingZeros int) {
+	zlog.Debug("looking for filename", zap.String("filename", layout.blockNumToStr(blockNum)))
+	for i, digit := range layout.blockNumToStr(blockNum) {
 		if digit == '0' && leadingZeros == 0 {
 			continue
 		}
@@ -80,7 +187,7 @@ func getLeadingZeroes(blockNum uint64) (leadingZeros int) {
 	return
 }
 
-func scanForHighestPrefix(ctx context.Context, store dstore.Store, chunckSize, blockNum uint64, lastPrefix string, level int) string {
+func scanForHighestPrefix(ctx context.Context, store dstore.Store, layout FilenameLayout, chunckSize, blockNum uint64, lastPrefix string, level int) string {
 	if level == -1 {
 		return lastPrefix
 	}
@@ -88,9 +195,9 @@ func scanForHighestPrefix(ctx context.Context, store dstore.Store, chunckSize, b
 	inc := chunckSize * uint64(math.Pow10(level))
 	for {
 		b := blockNum + inc
-		leadingZeroes := strings.Repeat("0", getLeadingZeroes(b))
-		prefix := leadingZeroes + strconv.Itoa(int(b))
-		exist := fileExistWithPrefix(ctx, prefix, store)
+		leadingZeroes := strings.Repeat("0", getLeadingZeroes(layout, b))
+		prefix := leadingZeroes + strconv.FormatUint(b, 10)
+		exist := fileExistWithPrefix(ctx, layout, prefix, store)
 		zlog.Debug("file with prefix", zap.String("prefix", prefix), zap.Bool("exist", exist))
 		if !exist {
 			break
@@ -98,27 +205,30 @@ func scanForHighestPrefix(ctx context.Context, store dstore.Store, chunckSize, b
 		blockNum = b
 		lastPrefix = prefix
 	}
-	return scanForHighestPrefix(ctx, store, chunckSize, blockNum, lastPrefix, level-1)
+	return scanForHighestPrefix(ctx, store, layout, chunckSize, blockNum, lastPrefix, level-1)
 }
 
-func highestFilePrefix(ctx context.Context, store dstore.Store, minimalBlockNum uint64, chuckSize uint64) (filePrefix string) {
-	leadingZeroes := strings.Repeat("0", getLeadingZeroes(minimalBlockNum))
-	blockNumStr := strconv.Itoa(int(minimalBlockNum))
+func highestFilePrefix(ctx context.Context, store dstore.Store, layout FilenameLayout, minimalBlockNum uint64, chuckSize uint64) (filePrefix string) {
+	leadingZeroes := strings.Repeat("0", getLeadingZeroes(layout, minimalBlockNum))
+	blockNumStr := strconv.FormatUint(minimalBlockNum, 10)
 	filePrefix = leadingZeroes + blockNumStr
 
-	if !fileExistWithPrefix(ctx, filePrefix, store) {
+	if !fileExistWithPrefix(ctx, layout, filePrefix, store) {
 		// prefix of minimalBlockNum not found.
 		// we consider it has the highest file prefix
 		zlog.Info("prefix of minimalBlockNum not found. we consider it has the highest file prefix")
 		return
 	}
 
-	filePrefix = scanForHighestPrefix(ctx, store, chuckSize, minimalBlockNum, filePrefix, 4)
+	filePrefix = scanForHighestPrefix(ctx, store, layout, chuckSize, minimalBlockNum, filePrefix, 4)
 	return
 }
 
-func fileExistWithPrefix(ctx context.Context, filePrefix string, s dstore.Store) bool {
-	needZeros := 10 - len(filePrefix)
+func fileExistWithPrefix(ctx context.Context, layout FilenameLayout, filePrefix string, s dstore.Store) bool {
+	needZeros := layout.digits() - len(filePrefix)
+	if needZeros < 0 {
+		return false // block number doesn't fit in this layout
+	}
 	resultFileName := filePrefix + strings.Repeat("0", needZeros)
 	exists, err := s.FileExists(ctx, resultFileName)
 	if err != nil {
@@ -130,7 +240,3 @@ func fileExistWithPrefix(ctx context.Context, filePrefix string, s dstore.Store)
 	}
 	return false
 }
-
-func fileNameForBlocksBundle(blockNum int64) string {
-	return fmt.Sprintf("%010d", blockNum)
-}
@@ -79,11 +79,13 @@ func TestWalkFS(t *testing.T) {
 func TestFindNextBaseBlock(t *testing.T) {
 
 	tests := []struct {
-		name              string
-		writtenFiles      []string
-		minimalBlockNum   uint64
-		chunkSize         uint64
-		expectedBaseBlock uint64
+		name                 string
+		writtenFiles         []string
+		minimalBlockNum      uint64
+		firstStreamableBlock uint64
+		mergedLayout         FilenameLayout
+		chunkSize            uint64
+		expectedBaseBlock    uint64
 	}{
 		{
 			name:              "zero",
@@ -134,6 +136,49 @@ func TestFindNextBaseBlock(t *testing.T) {
 			minimalBlockNum:   507,
 			expectedBaseBlock: 516,
 		},
+		{
+			name:                 "first_streamable_block",
+			writtenFiles:         []string{},
+			chunkSize:            100,
+			firstStreamableBlock: 1234,
+			expectedBaseBlock:    1200,
+		},
+		{
+			name:                 "first_streamable_block_below_minimal_num",
+			writtenFiles:         []string{},
+			chunkSize:            100,
+			minimalBlockNum:      8976500,
+			firstStreamableBlock: 1234,
+			expectedBaseBlock:    8976500,
+		},
+		{
+			name:              "wide_layout",
+			writtenFiles:      []string{"00000000000000000000", "00000000000000000100", "00000000000000000200"},
+			chunkSize:         100,
+			mergedLayout:      FilenameLayoutV1,
+			expectedBaseBlock: 300,
+		},
+		{
+			name:              "wide_layout_above_32_bits",
+			writtenFiles:      []string{"00000000004294967300", "00000000004294967400"},
+			chunkSize:         100,
+			minimalBlockNum:   4294967300,
+			mergedLayout:      FilenameLayoutV1,
+			expectedBaseBlock: 4294967500,
+		},
+		{
+			name:              "wide_layout_following_legacy",
+			writtenFiles:      []string{"0000000000", "0000000100", "00000000000000000200", "00000000000000000300"},
+			chunkSize:         100,
+			mergedLayout:      FilenameLayoutV1,
+			expectedBaseBlock: 400,
+		},
+		{
+			name:              "legacy_layout_ignores_wide",
+			writtenFiles:      []string{"0000000000", "0000000100", "00000000000000000200"},
+			chunkSize:         100,
+			expectedBaseBlock: 200,
+		},
 		{
 			name:              "absent_minimal_num",
 			writtenFiles:      []string{"0000000100", "0000003400", "0000010000"},
@@ -157,7 +202,7 @@ func TestFindNextBaseBlock(t *testing.T) {
 				require.NoError(t, err)
 			}
 
-			m := &Merger{destStore: s, chunkSize: test.chunkSize, minimalBlockNum: test.minimalBlockNum}
+			m := &Merger{destStore: s, chunkSize: test.chunkSize, minimalBlockNum: test.minimalBlockNum, firstStreamableBlock: test.firstStreamableBlock, mergedLayout: test.mergedLayout}
 			i, err := m.FindNextBaseBlock()
 			require.NoError(t, err)
 
@@ -166,3 +211,50 @@ func TestFindNextBaseBlock(t *testing.T) {
 		})
 	}
 }
+
+func TestListingPrefix(t *testing.T) {
+	assert.Equal(t, "00000001", FilenameLayoutV0.listingPrefix(100, 199))
+	assert.Equal(t, "0000000", FilenameLayoutV0.listingPrefix(100, 200))
+	assert.Equal(t, "000000", FilenameLayoutV0.listingPrefix(100, 9900))
+	assert.Equal(t, "0038918", FilenameLayoutV0.listingPrefix(38918000, 38918200))
+	assert.Equal(t, "0000000100", FilenameLayoutV0.listingPrefix(100, 100))
+	assert.Equal(t, "000000000000000001", FilenameLayoutV1.listingPrefix(100, 199))
+	assert.Equal(t, "00000000004294967", FilenameLayoutV1.listingPrefix(4294967295, 4294967399))
+}
+
+func TestParseFilenameWide(t *testing.T) {
+	num, _, id, prev, err := parseFilename("00000000004294967396-20170701T122141.0-24a07267-e5914b39")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4294967396), num)
+	assert.Equal(t, "24a07267", id)
+	assert.Equal(t, "e5914b39", prev)
+
+	num, _, _, _, err = parseFilename("0000000100-20170701T122141.0-24a07267-e5914b39")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), num)
+
+	assert.Equal(t, "00000000004294967396", FilenameLayoutV1.blockNumToStr(4294967396))
+	assert.Equal(t, "0000000100", FilenameLayoutV0.blockNumToStr(100))
+}
+
+func TestParseOneBlockFilename(t *testing.T) {
+	f, err := parseOneBlockFilename("0000000101-20170701T122141.5-dbda3f44-09f6d693")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(101), f.num)
+	assert.Equal(t, uint64(0), f.libNum)
+	assert.Equal(t, "", f.producer)
+
+	f, err = parseOneBlockFilename("0000000101-20170701T122141.5-dbda3f44-09f6d693-99-mindreader-us-east-1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(101), f.num)
+	assert.Equal(t, "dbda3f44", f.id)
+	assert.Equal(t, "09f6d693", f.previousID)
+	assert.Equal(t, uint64(99), f.libNum)
+	assert.Equal(t, "mindreader-us-east-1", f.producer)
+
+	_, err = parseOneBlockFilename("0000000101-20170701T122141.5-dbda3f44-09f6d693-99")
+	assert.Error(t, err)
+
+	_, err = parseOneBlockFilename("0000000101-20170701T122141.5-dbda3f44-09f6d693-abc-mindreader")
+	assert.Error(t, err)
+}
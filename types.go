@@ -22,5 +22,8 @@ type OneBlockFile struct {
 	id         string
 	num        uint64
 	previousID string
+	libNum     uint64 // 0 when not part of the filename
+	producer   string // identity of the process that produced the file, if part of the filename
 	blk        []byte
+	err        error // validation failure of the downloaded block, only kept when failures are quarantined
 }
@@ -15,28 +15,175 @@
 package merger
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
 	"time"
 
-	"gopkg.in/olivere/elastic.v3/backoff"
+	"cloud.google.com/go/storage"
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/merger/metrics"
+	"go.uber.org/zap"
 )
 
-func Retry(attempts int, sleep time.Duration, callback func() error) (err error) {
-	b := backoff.NewExponentialBackoff(sleep, 5*time.Second)
-	for i := 0; ; i++ {
+// RetryPolicy describes how operations against the stores are retried.
+type RetryPolicy struct {
+	Attempts    int           // maximum number of attempts, 0 means no limit other than Budget
+	Budget      time.Duration // time after which no more attempts are made, 0 means no limit other than Attempts
+	BaseBackoff time.Duration // wait before the second attempt, doubled on each following one
+	MaxBackoff  time.Duration
+	Jitter      float64 // fraction of the backoff randomly added or removed, between 0 and 1
+
+	// Retryable tells if an error is worth retrying, defaults to `IsRetryableError`
+	Retryable func(err error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:    5,
+		BaseBackoff: 500 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// Retry calls `callback` up to `attempts` times, waiting `sleep` then
+// exponentially longer, up to 5 seconds, between attempts.
+//
+// Deprecated: use a `RetryPolicy`, which honors shutdown and does not
+// retry errors that would happen again.
+func Retry(attempts int, sleep time.Duration, callback func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	policy := RetryPolicy{Attempts: attempts, BaseBackoff: sleep, MaxBackoff: 5 * time.Second, Retryable: func(error) bool { return true }}
+	return policy.Do("retry", nil, callback)
+}
+
+// IsRetryableError returns false for errors that would happen again
+// on every attempt, like missing objects or canceled contexts.
+func IsRetryableError(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, dstore.StopIteration):
+		return false
+	case IsNotExistError(err):
+		return false
+	}
+	return true
+}
+
+// IsNotExistError tells if `err` reports a missing object, whatever the
+// store that returned it.
+func IsNotExistError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+
+	var coded interface{ Code() string } // S3 errors
+	if errors.As(err, &coded) && (coded.Code() == "NotFound" || coded.Code() == "NoSuchKey") {
+		return true
+	}
+
+	// dstore sometimes wraps errors without keeping them
+	msg := err.Error()
+	return strings.HasSuffix(msg, storage.ErrObjectNotExist.Error()) || strings.Contains(msg, "BlobNotFound")
+}
+
+// Do calls `callback` until it succeeds, returns an error that is not
+// retryable, the policy is exhausted or `terminating` is closed. The
+// `operation` labels the retries metric and logs.
+func (p RetryPolicy) Do(operation string, terminating <-chan struct{}, callback func() error) (err error) {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
 		err = callback()
-		if err == nil {
-			return
+		if err == nil || !retryable(err) {
+			return err
+		}
+
+		if p.Attempts > 0 && attempt >= p.Attempts {
+			return fmt.Errorf("%s: after %d attempts, last error: %w", operation, attempt, err)
+		}
+		if p.Budget > 0 && time.Since(start) >= p.Budget {
+			return fmt.Errorf("%s: giving up after %d attempts in %s, last error: %w", operation, attempt, time.Since(start), err)
+		}
+
+		wait := p.backoff(attempt)
+		metrics.StoreOperationRetries.Inc(operation)
+		zlog.Warn("retrying after error", zap.String("operation", operation), zap.Int("attempt", attempt), zap.Duration("retry_in", wait), zap.Error(err))
+
+		select {
+		case <-time.After(wait):
+		case <-terminating:
+			return fmt.Errorf("%s: terminating while retrying, last error: %w", operation, err)
 		}
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.BaseBackoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return wait
+}
 
-		if i >= (attempts - 1) {
-			break
+// terminatingContext returns a context that is canceled after `timeout`
+// or as soon as the merger starts terminating.
+func (m *Merger) terminatingContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return contextWithCancelOn(m.Terminating(), timeout)
+}
+
+// contextWithCancelOn returns a context that is canceled after `timeout`
+// or as soon as `done` is closed. A nil `done` is never closed.
+func contextWithCancelOn(done <-chan struct{}, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+	return ctx, cancel
+}
 
-		time.Sleep(b.Next())
+// eitherDone returns a channel closed as soon as `a` or `b` is closed.
+func eitherDone(a, b <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(done)
+	}()
+	return done
+}
 
-		log.Println("retrying after error:", err)
+// writeFileAtomic writes to a temporary file renamed into place, so
+// readers never see a partially written file.
+func writeFileAtomic(filename string, content []byte) error {
+	if err := ioutil.WriteFile(filename+".tmp", content, 0644); err != nil {
+		return err
 	}
-	return fmt.Errorf("after %d attempts, last error: %s", attempts, err)
+	return os.Rename(filename+".tmp", filename)
 }
@@ -0,0 +1,103 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	failing := func(calls *int, failures int, err error) func() error {
+		return func() error {
+			*calls++
+			if *calls <= failures {
+				return err
+			}
+			return nil
+		}
+	}
+
+	policy := RetryPolicy{Attempts: 3, BaseBackoff: time.Millisecond}
+
+	var calls int
+	require.NoError(t, policy.Do("test", nil, failing(&calls, 2, fmt.Errorf("transient"))))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err := policy.Do("test", nil, failing(&calls, 3, fmt.Errorf("transient")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after 3 attempts")
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = policy.Do("test", nil, failing(&calls, 3, storage.ErrObjectNotExist))
+	assert.Equal(t, storage.ErrObjectNotExist, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	_, notExist := os.Open("/does/not/exist")
+	err = policy.Do("test", nil, failing(&calls, 3, notExist))
+	assert.Equal(t, notExist, err)
+	assert.Equal(t, 1, calls, "missing objects of local stores are not retried")
+
+	calls = 0
+	terminating := make(chan struct{})
+	close(terminating)
+	slow := RetryPolicy{BaseBackoff: time.Hour}
+	err = slow.Do("test", terminating, failing(&calls, 3, fmt.Errorf("transient")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "terminating")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, time.Second, policy.backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		wait := policy.backoff(2)
+		assert.True(t, wait >= 100*time.Millisecond && wait <= 300*time.Millisecond, "wait %s", wait)
+	}
+}
+
+type codedError string
+
+func (e codedError) Error() string { return "aws error: " + string(e) }
+func (e codedError) Code() string  { return string(e) }
+
+func TestIsNotExistError(t *testing.T) {
+	_, osErr := os.Open("/does/not/exist")
+
+	assert.True(t, IsNotExistError(osErr))
+	assert.True(t, IsNotExistError(fmt.Errorf("deleting: %w", osErr)))
+	assert.True(t, IsNotExistError(storage.ErrObjectNotExist))
+	assert.True(t, IsNotExistError(fmt.Errorf("reading: %s", storage.ErrObjectNotExist)))
+	assert.True(t, IsNotExistError(codedError("NotFound")))
+	assert.True(t, IsNotExistError(fmt.Errorf("-> github.com/Azure/azure-storage-blob-go/azblob.newStorageError, ServiceCode=BlobNotFound")))
+
+	assert.False(t, IsNotExistError(nil))
+	assert.False(t, IsNotExistError(codedError("AccessDenied")))
+	assert.False(t, IsNotExistError(fmt.Errorf("transient")))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// sourceWatcher receives inotify events from a local one-block files
+// store and accumulates the base names of the files that were renamed
+// into place, so the merger does not need to walk the whole directory
+// on every lookup.
+type sourceWatcher struct {
+	dir    string
+	suffix string // extension added by the store, like ".dbin.zst"
+
+	watcher *fsnotify.Watcher
+	notify  chan struct{}
+
+	lock    sync.Mutex
+	pending []string
+}
+
+func newSourceWatcher(store dstore.Store) (*sourceWatcher, error) {
+	if _, ok := store.(*dstore.LocalStore); !ok {
+		return nil, fmt.Errorf("filesystem watch is only supported on local stores")
+	}
+
+	// The store does not expose its base path or extension, we derive
+	// them from the path of a known object name.
+	samplePath := store.ObjectPath("sample")
+	dir := filepath.Dir(samplePath)
+	suffix := strings.TrimPrefix(filepath.Base(samplePath), "sample")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watching %q: %w", dir, err)
+	}
+
+	return &sourceWatcher{
+		dir:     dir,
+		suffix:  suffix,
+		watcher: watcher,
+		notify:  make(chan struct{}, 1),
+	}, nil
+}
+
+// run consumes the watcher events until Close is called.
+func (w *sourceWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(ev)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Overflows and such are covered by the periodic full walk
+			zlog.Warn("one-block files watcher error", zap.Error(err))
+		}
+	}
+}
+
+func (w *sourceWatcher) handleEvent(ev fsnotify.Event) {
+	// Files are written to a `.tmp` then renamed into place, which
+	// shows up as a `Create` event for the final name.
+	if ev.Op&fsnotify.Create == 0 {
+		return
+	}
+
+	name := filepath.Base(ev.Name)
+	if strings.HasSuffix(name, ".tmp") || !strings.HasSuffix(name, w.suffix) {
+		return
+	}
+
+	w.lock.Lock()
+	w.pending = append(w.pending, strings.TrimSuffix(name, w.suffix))
+	w.lock.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Notify returns a channel receiving a value when new files are
+// pending, to be retrieved with `drain`.
+func (w *sourceWatcher) Notify() <-chan struct{} {
+	return w.notify
+}
+
+// drain returns the sorted list of filenames seen since the last call.
+func (w *sourceWatcher) drain() (out []string) {
+	w.lock.Lock()
+	out = w.pending
+	w.pending = nil
+	w.lock.Unlock()
+
+	sort.Strings(out)
+	return
+}
+
+func (w *sourceWatcher) Close() error {
+	return w.watcher.Close()
+}
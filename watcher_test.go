@@ -0,0 +1,86 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package merger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceWatcher(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	store, err := dstore.NewDBinStore(tmpdir)
+	require.NoError(t, err)
+
+	w, err := newSourceWatcher(store)
+	require.NoError(t, err)
+	defer w.Close()
+	go w.run()
+
+	writeOneBlockFile(testBlockForFile(blk101.filename), blk101.filename, store)
+	writeOneBlockFile(testBlockForFile(blk100.filename), blk100.filename, store)
+
+	var files []string
+	timeout := time.After(5 * time.Second)
+	for len(files) < 2 {
+		select {
+		case <-w.Notify():
+			files = append(files, w.drain()...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for watcher, got %v", files)
+		}
+	}
+
+	assert.ElementsMatch(t, []string{blk100.filename, blk101.filename}, files)
+}
+
+func TestSourceWatcherRemoteStore(t *testing.T) {
+	_, err := newSourceWatcher(dstore.NewMockStore(nil))
+	assert.Error(t, err)
+}
+
+func TestNextListOfFilesKeepsWatchedFiles(t *testing.T) {
+	m, src, _, cleanup := setupMerger(t)
+	defer cleanup()
+	m.seenBlocks.Reset()
+
+	WithFilesystemWatch(0)(m)
+	assert.Equal(t, DefaultTimeBetweenFullWalks, m.timeBetweenFullWalks)
+
+	w, err := newSourceWatcher(src)
+	require.NoError(t, err)
+	defer w.Close()
+	m.watcher = w
+	m.lastFullWalk = time.Now()
+
+	// kept from a previous lookup, while the bundle was waiting on the leeway
+	m.watchedFiles = []string{blk101.filename}
+	w.pending = []string{blk100.filename, blk101.filename}
+
+	_, _, good, err := m.nextListOfFiles(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{blk100.filename, blk101.filename}, good)
+	assert.Nil(t, m.watchedFiles)
+}